@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The body of a successful /api/search response.
+type apiSearchResponse struct {
+	Query string `json:"query"`
+	// The amount of results on every page.
+	Total  int `json:"total"`
+	Page   int `json:"page"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	// The url of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+	// The query with its misspelled words corrected, and whether the
+	// results are for it because the query had none.
+	Suggestion string `json:"suggestion,omitempty"`
+	Corrected  bool   `json:"corrected,omitempty"`
+	// The words each wildcard in the query matched.
+	Expansions []Expansion `json:"expansions,omitempty"`
+	Results    []apiResult `json:"results"`
+}
+
+type apiResult struct {
+	URL     string  `json:"url"`
+	Title   string  `json:"title"`
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+	// The words of the snippet that match the query.
+	Highlights []Highlight `json:"highlights"`
+}
+
+// The body of a failed API response.
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	// bad_query, method_not_allowed or internal.
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serves the same searches as the results page as JSON, for tools:
+// /api/search?term=query&wildcard=on&scorer=bm25&limit=10&offset=20. A
+// search without results is not an error, and has a total of 0.
+func (ebook *Index) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use GET")
+		return
+	}
+
+	request, err := ebook.parseSearchRequest(r)
+	var found searchResults
+	if err == nil {
+		found, err = ebook.runSearchRequest(request)
+	}
+	results, total := found.results, found.total
+	if errors.Is(err, ErrParse) {
+		writeAPIError(w, http.StatusBadRequest, "bad_query", parseErrorMessage(err))
+		return
+	}
+	if err != nil {
+		fmt.Println("Search for", request.query, "failed:", err)
+		writeAPIError(w, http.StatusInternalServerError, "internal", "the search could not be completed")
+		return
+	}
+
+	response := apiSearchResponse{
+		Query:      request.query,
+		Total:      total,
+		Page:       request.offset/request.limit + 1,
+		Offset:     request.offset,
+		Limit:      request.limit,
+		Results:    make([]apiResult, 0, len(results)),
+		Suggestion: found.suggestion,
+		Corrected:  found.corrected,
+		Expansions: found.expansions,
+	}
+	if found.corrected {
+		// Later pages are of the correction.
+		request.query = found.suggestion
+	}
+	if request.offset+len(results) < total {
+		response.Next = request.pageURL(r.URL.Path, request.offset+len(results))
+	}
+	for _, result := range results {
+		highlighted := result.Highlights
+		if highlighted == nil {
+			highlighted = []Highlight{}
+		}
+		response.Results = append(response.Results, apiResult{
+			URL:        result.URL,
+			Title:      result.Title,
+			Score:      result.TfIdf,
+			Snippet:    result.Snippet,
+			Highlights: highlighted,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiErrorResponse{Error: apiError{Code: code, Message: message}})
+}
+
+// Write the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		fmt.Println("Could not encode response:", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":{"code":"internal","message":"could not encode the response"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultSeed = "https://openai.com"
+
+// Config holds the settings shared by every subcommand.
+type Config struct {
+	seeds         []string
+	userAgent     string
+	dbPath        string
+	addr          string
+	stopWords     string
+	recursive     bool
+	sameHost      bool
+	stripTracking bool
+	maxDepth      int
+	maxPages      int
+	workers       int
+	hostLimit     int
+	globalLimit   int
+	timeout       time.Duration
+	robotsTTL     time.Duration
+	scorer        string
+	fieldWeights  string
+	bm25K1        float64
+	bm25B         float64
+	// How much the authority of a url counts towards its score, from 0 to 1.
+	authorityWeight float64
+	// The amount of results on a page when a search does not give a limit,
+	// and the largest limit a search may give.
+	pageSize int
+	maxLimit int
+	// Whether a query without results is searched again as its spelling
+	// correction.
+	autocorrect bool
+	// The most words a wildcard pattern is expanded to.
+	maxExpansions int
+}
+
+// Register the flags common to all subcommands on the given flag set.
+func (config *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.dbPath, "db", "", "path to the SQLite database, or :memory: to keep the index in memory (default: <seed subdomain>.db)")
+	fs.StringVar(&config.stopWords, "stopwords", "stopwords-en.json", "path to the JSON stopword list")
+	fs.StringVar(&config.scorer, "scorer", "tfidf", "how to rank results: "+strings.Join(scorerNames, ", "))
+	fs.StringVar(&config.fieldWeights, "field-weights", defaultFieldWeights, "how much a term counts in each field, as field=weight pairs separated by commas")
+	fs.Float64Var(&config.bm25K1, "bm25-k1", 1.2, "how quickly more occurrences of a term stop raising its bm25 score")
+	fs.Float64Var(&config.bm25B, "bm25-b", 0.75, "how much bm25 penalises long pages, from 0 to 1")
+	fs.Float64Var(&config.authorityWeight, "authority-weight", 0.3, "how much the authority computed by pagerank counts towards a score, from 0 to 1")
+	fs.IntVar(&config.maxExpansions, "max-expansions", 50, "the most words a wildcard such as colo?r is expanded to")
+	fs.BoolVar(&config.autocorrect, "autocorrect", false, "search the spelling correction of a query without results instead")
+}
+
+// Fill in the defaults that depend on other settings.
+func (config *Config) resolve() {
+	if len(config.seeds) == 0 {
+		config.seeds = []string{defaultSeed}
+	}
+	if config.dbPath == "" {
+		config.dbPath = extractSubdomain(config.seeds[0]) + ".db"
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: project06 <command> [flags] [args]
+
+Commands:
+  crawl     crawl the given seed URLs into the database
+  serve     serve the search page for a database
+  search    run a single query against a database
+  stats     print the size of a database
+  pagerank  compute the authority of every url from the links between them
+  links     write the links between urls for analysis
+
+Run "project06 <command> -h" for the flags of a command.`)
+}
+
+func run(args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "crawl":
+		runCrawl(args[1:])
+	case "serve":
+		runServe(args[1:])
+	case "search":
+		runSearch(args[1:])
+	case "stats":
+		runStats(args[1:])
+	case "pagerank":
+		runPageRank(args[1:])
+	case "links":
+		runLinks(args[1:])
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+}
+
+// Open the database and load the stopwords described by config.
+func openIndex(config Config) *Index {
+	stopWords, err := createSWmap(config.stopWords)
+	if err != nil {
+		log.Fatalf("Could not load stopwords: %v", err)
+	}
+	StopWords = stopWords
+	ebook := &Index{config: config}
+	ebook.frontier = newFrontier(config.maxDepth, config.maxPages)
+	ebook.robots = newRobotsCache(config)
+	ebook.fetcher = newFetcher(config, ebook.robots)
+	if config.dbPath == ":memory:" {
+		ebook.store = newMemoryStore()
+	} else {
+		store, err := openSQLiteStore(config.dbPath)
+		if err != nil {
+			log.Fatalf("Could not open database: %v", err)
+		}
+		ebook.store = store
+	}
+	ebook.databaseName = strings.TrimSuffix(filepath.Base(config.dbPath), ".db")
+	scorer, err := newScorer(config.scorer, config.bm25K1, config.bm25B)
+	if err != nil {
+		log.Fatalf("Could not rank results: %v", err)
+	}
+	ebook.scorer = scorer
+	if ebook.fieldWeights, err = parseFieldWeights(config.fieldWeights); err != nil {
+		log.Fatalf("Could not rank results: %v", err)
+	}
+	if config.maxExpansions < 1 {
+		log.Fatalf("-max-expansions must be at least 1")
+	}
+	return ebook
+}
+
+// project06 crawl [flags] [seed urls...]
+func runCrawl(args []string) {
+	var config Config
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.BoolVar(&config.recursive, "recursive", true, "follow links found on crawled pages")
+	fs.BoolVar(&config.sameHost, "same-host", true, "only follow links to the host of the page they are on")
+	fs.BoolVar(&config.stripTracking, "strip-tracking", true, "remove tracking parameters such as utm_source from urls")
+	fs.IntVar(&config.maxDepth, "depth", 3, "how many links deep to follow from a seed (-1 for no limit)")
+	fs.IntVar(&config.maxPages, "max-pages", 1000, "maximum amount of pages to crawl (0 for no limit)")
+	fs.IntVar(&config.workers, "workers", 8, "amount of download workers")
+	fs.IntVar(&config.hostLimit, "host-limit", 2, "maximum concurrent downloads from a single host")
+	fs.IntVar(&config.globalLimit, "global-limit", 8, "maximum concurrent downloads overall")
+	fs.StringVar(&config.userAgent, "user-agent", "project06", "user-agent sent with requests and matched against robots.txt")
+	fs.DurationVar(&config.timeout, "timeout", 30*time.Second, "time limit for downloading a single page")
+	fs.DurationVar(&config.robotsTTL, "robots-ttl", 24*time.Hour, "how long to cache each host's robots.txt")
+	fs.Parse(args)
+	config.seeds = fs.Args()
+	config.resolve()
+
+	ebook := openIndex(config)
+	for _, seed := range config.seeds {
+		if err := ebook.createRobotMap(seed); err != nil {
+			log.Fatalf("Could not read sitemaps of %s: %v", seed, err)
+		}
+		if err := ebook.crawlDatabase(seed); err != nil {
+			log.Fatalf("Could not crawl %s: %v", seed, err)
+		}
+	}
+	fmt.Println("Finished crawling all urls.")
+}
+
+// project06 serve [flags]
+func runServe(args []string) {
+	var config Config
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.StringVar(&config.addr, "addr", ":8080", "address for the HTTP server to listen on")
+	fs.IntVar(&config.pageSize, "page-size", 10, "results on a page when the search gives no limit")
+	fs.IntVar(&config.maxLimit, "max-limit", 100, "the most results a search may ask for at once")
+	fs.Parse(args)
+	if config.pageSize < 1 || config.maxLimit < config.pageSize {
+		log.Fatalf("-page-size must be at least 1 and at most -max-limit")
+	}
+	config.resolve()
+
+	ebook := openIndex(config)
+
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
+
+	// Serve the "static" folder at the base URL ("/")
+	http.Handle("/", http.FileServer(http.Dir("static")))
+	// when the server reaches the /search url, use the function search
+	http.HandleFunc("/search", ebook.searchHandlerDatabase)
+	// The same searches as JSON
+	http.HandleFunc("/api/search", ebook.apiSearchHandler)
+	// Completions for the search bar
+	http.HandleFunc("/api/suggest", ebook.apiSuggestHandler)
+
+	// Start the HTTP server in a goroutine
+	go func() {
+		fmt.Println("Starting HTTP server on " + config.addr)
+		if err := http.ListenAndServe(config.addr, nil); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-exit
+	log.Println("Shutting down server.")
+}
+
+// project06 search [flags] <query>
+func runSearch(args []string) {
+	var config Config
+	var options SearchOptions
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.BoolVar(&options.wildcard, "wildcard", false, "also match words starting with the last word of the query")
+	fs.IntVar(&options.offset, "offset", 0, "the amount of results to skip")
+	fs.IntVar(&options.limit, "limit", 10, "the most results to print, or 0 for all of them")
+	fs.Parse(args)
+	if options.offset < 0 || options.limit < 0 {
+		fmt.Fprintln(os.Stderr, "-offset and -limit must be at least 0")
+		os.Exit(2)
+	}
+	config.resolve()
+
+	query := strings.Join(fs.Args(), " ")
+	if query == "" {
+		fmt.Fprintln(os.Stderr, "Usage: project06 search [flags] <query>")
+		os.Exit(2)
+	}
+
+	ebook := openIndex(config)
+	options.scorer = ebook.scorer
+	found, err := ebook.correctedSearch(query, options, config.autocorrect)
+	if err != nil {
+		log.Fatalf("Search failed: %v", err)
+	}
+	results, total := found.results, found.total
+	for _, expansion := range found.expansions {
+		fmt.Println("Wildcard " + expansion.message() + ".")
+	}
+	if found.corrected {
+		fmt.Println("Showing results for " + found.suggestion + ".")
+	} else if found.suggestion != "" {
+		fmt.Println("Did you mean: " + found.suggestion + "?")
+	}
+	if total == 0 {
+		fmt.Println("Word: " + query + " not found.")
+		return
+	}
+	for _, result := range results {
+		fmt.Printf("%.6f  %s\n          %s\n", result.TfIdf, result.Title, result.URL)
+	}
+	if len(results) == 0 {
+		fmt.Printf("There are only %d results.\n", total)
+		return
+	}
+	fmt.Printf("Results %d-%d of %d.\n", options.offset+1, options.offset+len(results), total)
+}
+
+// project06 stats [flags]
+func runStats(args []string) {
+	var config Config
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.Parse(args)
+	config.resolve()
+
+	ebook := openIndex(config)
+	fmt.Println("Database:", config.dbPath)
+	stats, err := ebook.store.stats()
+	if err != nil {
+		log.Fatalf("Could not read stats: %v", err)
+	}
+	for _, stat := range stats {
+		fmt.Printf("  %-12s %d\n", stat.name, stat.count)
+	}
+}
+
+// project06 pagerank [flags]
+func runPageRank(args []string) {
+	var config Config
+	var damping, tolerance float64
+	var iterations int
+	fs := flag.NewFlagSet("pagerank", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.Float64Var(&damping, "damping", 0.85, "chance of following a link rather than jumping to any url")
+	fs.IntVar(&iterations, "iterations", 100, "maximum amount of iterations")
+	fs.Float64Var(&tolerance, "tolerance", 1e-6, "stop once the ranks change by less than this in total")
+	fs.Parse(args)
+	config.resolve()
+
+	ebook := openIndex(config)
+	authority, ran, err := ebook.computeAuthority(damping, iterations, tolerance)
+	if err != nil {
+		log.Fatalf("Could not compute authority: %v", err)
+	}
+	fmt.Printf("Computed the authority of %d urls in %d iterations.\n", len(authority), ran)
+
+	urlIDs := make([]int, 0, len(authority))
+	for urlID := range authority {
+		urlIDs = append(urlIDs, urlID)
+	}
+	sort.Slice(urlIDs, func(i, j int) bool {
+		if authority[urlIDs[i]] == authority[urlIDs[j]] {
+			return urlIDs[i] < urlIDs[j]
+		}
+		return authority[urlIDs[i]] > authority[urlIDs[j]]
+	})
+	urlIDs = urlIDs[:min(len(urlIDs), 10)]
+	stats, err := ebook.store.docStats(urlIDs)
+	if err != nil {
+		log.Fatalf("Could not read url: %v", err)
+	}
+	for _, urlID := range urlIDs {
+		fmt.Printf("%.4f  %s\n", authority[urlID], stats[urlID].url)
+	}
+}
+
+// project06 links [flags]
+func runLinks(args []string) {
+	var config Config
+	var format string
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	config.registerFlags(fs)
+	fs.StringVar(&format, "format", "csv", "output format: "+strings.Join(linkFormats, ", "))
+	fs.Parse(args)
+	config.resolve()
+	if !slices.Contains(linkFormats, format) {
+		fmt.Fprintf(os.Stderr, "Unknown format %q, choose one of %s\n", format, strings.Join(linkFormats, ", "))
+		os.Exit(2)
+	}
+
+	ebook := openIndex(config)
+	links, err := ebook.store.links()
+	if err != nil {
+		log.Fatalf("Could not read links: %v", err)
+	}
+	if err := writeLinks(os.Stdout, links, format); err != nil {
+		log.Fatalf("Could not write links: %v", err)
+	}
+}
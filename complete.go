@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The most completions a prefix can ask for, and how many it gets when it
+// does not ask.
+const (
+	maxCompletions     = 20
+	defaultCompletions = 8
+)
+
+// A word or bigram in the index that completes a prefix.
+type Completion struct {
+	Text string `json:"text"`
+	// The amount of urls it occurs in.
+	Documents int `json:"documents"`
+}
+
+// A prefix tree of the words and bigrams in the index. Every node keeps the
+// best completions below it, so completing a prefix only walks the prefix.
+type completer struct {
+	root *completionNode
+}
+
+type completionNode struct {
+	children map[rune]*completionNode
+	// The completions below the node in the most urls, best first.
+	best []Completion
+}
+
+func newCompleter(completions []Completion) *completer {
+	// Adding the completions best first keeps the best completions of every
+	// node in order without sorting them again.
+	sort.Slice(completions, func(i, j int) bool {
+		if completions[i].Documents == completions[j].Documents {
+			return completions[i].Text < completions[j].Text
+		}
+		return completions[i].Documents > completions[j].Documents
+	})
+	c := &completer{root: &completionNode{}}
+	for _, completion := range completions {
+		node := c.root
+		node.add(completion)
+		for _, r := range completion.Text {
+			child := node.children[r]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[rune]*completionNode)
+				}
+				child = &completionNode{}
+				node.children[r] = child
+			}
+			node = child
+			node.add(completion)
+		}
+	}
+	return c
+}
+
+func (node *completionNode) add(completion Completion) {
+	if len(node.best) < maxCompletions {
+		node.best = append(node.best, completion)
+	}
+}
+
+// Returns at most limit of the words and bigrams that start with the prefix,
+// in the most urls first.
+func (c *completer) complete(prefix string, limit int) []Completion {
+	node := c.root
+	for _, r := range prefix {
+		if node = node.children[r]; node == nil {
+			return nil
+		}
+	}
+	return node.best[:min(limit, len(node.best))]
+}
+
+// Returns the completer for the words and bigrams in the index, reading them
+// the first time it is needed. Restart the server after a crawl to complete
+// new terms.
+func (ebook *Index) completer() (*completer, error) {
+	ebook.completerMu.Lock()
+	defer ebook.completerMu.Unlock()
+
+	if ebook.completerCache == nil {
+		vocabulary, err := ebook.store.vocabulary()
+		if err != nil {
+			return nil, err
+		}
+		bigrams, err := ebook.store.bigramVocabulary()
+		if err != nil {
+			return nil, err
+		}
+		// Terms are completed as they are most often written, and as stems
+		// when they were indexed before the way they are written was kept.
+		forms, err := ebook.store.commonSurfaceForms()
+		if err != nil {
+			return nil, err
+		}
+		written := func(term string) string {
+			if form, exists := forms[term]; exists {
+				return form
+			}
+			return term
+		}
+		completions := make([]Completion, 0, len(vocabulary)+len(bigrams))
+		for term, documents := range vocabulary {
+			completions = append(completions, Completion{Text: written(term), Documents: documents})
+		}
+		for bigram, documents := range bigrams {
+			completions = append(completions, Completion{Text: written(bigram[0]) + " " + written(bigram[1]), Documents: documents})
+		}
+		ebook.completerCache = newCompleter(completions)
+	}
+	return ebook.completerCache, nil
+}
+
+// Lower cases the prefix and puts a single space between its words, keeping
+// a space at the end so that bigrams of a whole word can be completed.
+func normalizePrefix(prefix string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(prefix)), " ")
+	if normalized != "" && strings.TrimRightFunc(prefix, unicode.IsSpace) != prefix {
+		normalized += " "
+	}
+	return normalized
+}
+
+// The body of a successful /api/suggest response.
+type apiSuggestResponse struct {
+	Prefix      string       `json:"prefix"`
+	Suggestions []Completion `json:"suggestions"`
+}
+
+// Serves completions of what is typed in the search bar, for
+// /api/suggest?prefix=lang&limit=8. An empty prefix has no completions.
+func (ebook *Index) apiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use GET")
+		return
+	}
+
+	params := r.URL.Query()
+	limit := defaultCompletions
+	if text := params.Get("limit"); text != "" {
+		var err error
+		limit, err = strconv.Atoi(text)
+		if err != nil || limit < 1 || limit > maxCompletions {
+			writeAPIError(w, http.StatusBadRequest, "bad_query", "limit must be a number from 1 to "+strconv.Itoa(maxCompletions))
+			return
+		}
+	}
+
+	prefix := normalizePrefix(params.Get("prefix"))
+	response := apiSuggestResponse{Prefix: prefix, Suggestions: []Completion{}}
+	if strings.TrimSpace(prefix) != "" {
+		c, err := ebook.completer()
+		if err != nil {
+			fmt.Println("Could not load suggestions:", err)
+			writeAPIError(w, http.StatusInternalServerError, "internal", "the suggestions could not be loaded")
+			return
+		}
+		response.Suggestions = append(response.Suggestions, c.complete(prefix, limit)...)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
 	"net/url"
 	"strings"
+	"time"
 
-	"github.com/kljensen/snowball"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -34,430 +34,857 @@ func extractSubdomain(rawURL string) string {
 	return parts[0]
 }
 
-// Create all the initial tables if they do not exist.
-func (ebook *Index) initializeDatabase(url string) error {
-	subDomain := extractSubdomain(url)
-	ebook.databaseName = subDomain
-	db, err := sql.Open("sqlite3", subDomain+".db")
+// A Store kept in a SQLite database.
+type sqliteStore struct {
+	db      *sql.DB
+	queries prepStatements
+}
+
+type prepStatements struct {
+	insertURLTitle    *sql.Stmt
+	insertWord        *sql.Stmt
+	insertURL         *sql.Stmt
+	getURLID          *sql.Stmt
+	getWordID         *sql.Stmt
+	getPostings       *sql.Stmt
+	getBigramPostings *sql.Stmt
+	getPositions      *sql.Stmt
+	getAnchorCounts   *sql.Stmt
+	isIndexed         *sql.Stmt
+	getDocCount       *sql.Stmt
+	getTotalWords     *sql.Stmt
+	getLinks          *sql.Stmt
+	getVocabulary     *sql.Stmt
+	getBigramVocab    *sql.Stmt
+	getSurfaceMatches *sql.Stmt
+	getSurfaceForms   *sql.Stmt
+	getSentencesFrom  *sql.Stmt
+	insertSkipped     *sql.Stmt
+	upsertSchedule    *sql.Stmt
+	getSchedule       *sql.Stmt
+}
+
+// Open the database at the given path, creating it or upgrading it to the
+// current schema as needed.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	// In WAL mode searches can read while a crawl writes, and syncing only
+	// at checkpoints is safe, which makes bulk loading much faster.
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return nil, storageError("could not open database", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	// Create the table if it doesn't already exist.
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS urls (
-			id INTEGER NOT NULL PRIMARY KEY,
-			name TEXT,
-			title TEXT
-		)
-	`)
+	store := &sqliteStore{db: db}
+	if err := store.prepareStatements(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *sqliteStore) prepareStatements() error {
+	stmt := "UPDATE urls SET title=? WHERE name =?"
+	insertURLTitleStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not create urls table %v", err)
-		return err
+		return storageError("could not prepare "+stmt, err)
 	}
+	store.queries.insertURLTitle = insertURLTitleStmt
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS words (
-			id INTEGER NOT NULL PRIMARY KEY,
-			name TEXT
-		)
-	`)
+	stmt = "INSERT INTO words (name) VALUES (?) ON CONFLICT(name) DO NOTHING"
+	insertWordStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not create words table %v", err)
-		return err
+		return storageError("could not prepare "+stmt, err)
 	}
+	store.queries.insertWord = insertWordStmt
 
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS sentences (
-			id INTEGER NOT NULL PRIMARY KEY,
-			sentence TEXT,
-			url_id INTEGER,
-			UNIQUE(sentence, url_id),
-			FOREIGN KEY (url_id) REFERENCES urls(id)
-		)
-	`)
+	stmt = "INSERT INTO urls (name) VALUES (?) ON CONFLICT(name) DO NOTHING"
+	insertURLStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not create or open sentences table %v", err)
-		return err
+		return storageError("could not prepare "+stmt, err)
 	}
+	store.queries.insertURL = insertURLStmt
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS frequency (
-			id INTEGER NOT NULL PRIMARY KEY,
-			url_id INTEGER,
-			word_id INTEGER,
-			sentence_id INTEGER,
-			occurrences INTEGER,
-			FOREIGN KEY (url_id) REFERENCES urls(id),
-			FOREIGN KEY (word_id) REFERENCES words(id),
-			FOREIGN KEY (sentence_id) REFERENCES sentences(id)
-		)
-	`)
-	if err != nil {
-		log.Fatalf("Could not create or open frequency table %v", err)
-		return err
+	stmt = "SELECT id FROM urls WHERE name=?"
+	getURLIDStmt, err := store.db.Prepare(stmt)
+	if err != nil {
+		return storageError("could not prepare "+stmt, err)
 	}
+	store.queries.getURLID = getURLIDStmt
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS bigrams (
-			id INTEGER NOT NULL PRIMARY KEY,
-			url_id INTEGER,
-			word1_id INTEGER,
-			word2_id INTEGER,
-			sentence_id INTEGER,
-			occurrences INTEGER,
-			FOREIGN KEY (url_id) REFERENCES urls(id),
-			FOREIGN KEY (word1_id) REFERENCES words(id),
-			FOREIGN KEY (word2_id) REFERENCES words(id),
-			FOREIGN KEY (sentence_id) REFERENCES sentences(id)
-		)
-	`)
-	if err != nil {
-		log.Fatalf("Could not create or open bigrams table %v", err)
-		return err
+	stmt = "SELECT id FROM words WHERE name=?"
+	getWordIDStmt, err := store.db.Prepare(stmt)
+	if err != nil {
+		return storageError("could not prepare "+stmt, err)
 	}
+	store.queries.getWordID = getWordIDStmt
 
-	ebook.db = db
-	ebook.prepareStatements()
+	stmt = "SELECT url_id, occurrences, sentence_id FROM frequency WHERE word_id=?"
+	getPostingsStmt, err := store.db.Prepare(stmt)
+	if err != nil {
+		return storageError("could not prepare "+stmt, err)
+	}
+	store.queries.getPostings = getPostingsStmt
 
-	return nil
-}
+	stmt = "SELECT url_id, occurrences, sentence_id FROM bigrams WHERE word1_id=? AND word2_id=?"
+	getBigramPostingsStmt, err := store.db.Prepare(stmt)
+	if err != nil {
+		return storageError("could not prepare "+stmt, err)
+	}
+	store.queries.getBigramPostings = getBigramPostingsStmt
 
-func (ebook *Index) prepareStatements() {
-	stmt := "UPDATE urls SET title=? WHERE name =?"
-	addTitleStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT url_id, position, sentence_id, field FROM positions WHERE word_id=? ORDER BY url_id, position"
+	getPositionsStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.insertURLTitle = addTitleStmt
+	store.queries.getPositions = getPositionsStmt
 
-	stmt = "INSERT INTO words (name) VALUES (?)"
-	insertWordStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT url_id, SUM(occurrences) FROM anchor_terms WHERE word_id=? GROUP BY url_id"
+	getAnchorCountsStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.insertWord = insertWordStmt
+	store.queries.getAnchorCounts = getAnchorCountsStmt
 
-	stmt = "INSERT INTO urls (name) VALUES (?)"
-	insertURLStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT index_version>=? FROM urls WHERE id=?"
+	isIndexedStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.insertURL = insertURLStmt
+	store.queries.isIndexed = isIndexedStmt
 
-	stmt = "SELECT id FROM urls WHERE name=?"
-	getURLIDStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT documents FROM corpus_stats"
+	getDocCountStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getURLID = getURLIDStmt
+	store.queries.getDocCount = getDocCountStmt
 
-	stmt = "SELECT name FROM urls WHERE id=?"
-	getURLStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT total_terms FROM corpus_stats"
+	getTotalWordsStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getURL = getURLStmt
+	store.queries.getTotalWords = getTotalWordsStmt
 
-	stmt = "SELECT id FROM words WHERE name=?"
-	getWordIDStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT words.name, COUNT(*) FROM frequency JOIN words ON words.id=frequency.word_id GROUP BY frequency.word_id"
+	getVocabularyStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getWordID = getWordIDStmt
+	store.queries.getVocabulary = getVocabularyStmt
 
-	stmt = "SELECT name FROM words WHERE id=?"
-	getWordStmt, err := ebook.db.Prepare(stmt)
+	stmt = `SELECT word1.name, word2.name, COUNT(*) FROM bigrams
+		JOIN words word1 ON word1.id=bigrams.word1_id JOIN words word2 ON word2.id=bigrams.word2_id
+		GROUP BY bigrams.word1_id, bigrams.word2_id`
+	getBigramVocabStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getWord = getWordStmt
+	store.queries.getBigramVocab = getBigramVocabStmt
 
-	stmt = "SELECT title FROM urls WHERE id=?"
-	getTitleStmt, err := ebook.db.Prepare(stmt)
+	stmt = `SELECT surface_forms.form, words.name, COUNT(*) FROM surface_forms
+		JOIN words ON words.id=surface_forms.word_id WHERE surface_forms.form GLOB ?
+		GROUP BY surface_forms.form ORDER BY COUNT(*) DESC, surface_forms.form LIMIT ?`
+	getSurfaceMatchesStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getTitle = getTitleStmt
+	store.queries.getSurfaceMatches = getSurfaceMatchesStmt
 
-	stmt = "SELECT occurrences FROM frequency WHERE url_id=? AND word_id=?"
-	getFreqStmt, err := ebook.db.Prepare(stmt)
+	stmt = `SELECT surface_forms.form, words.name, COUNT(*) FROM surface_forms
+		JOIN words ON words.id=surface_forms.word_id GROUP BY surface_forms.form`
+	getSurfaceFormsStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getFreq = getFreqStmt
+	store.queries.getSurfaceForms = getSurfaceFormsStmt
 
-	stmt = "SELECT occurrences FROM bigrams WHERE url_id=? AND word1_id=? AND word2_id=?"
-	getBigramFreqStmt, err := ebook.db.Prepare(stmt)
+	stmt = `SELECT links.from_url_id, links.to_url_id, source.name, target.name, links.anchor_text
+		FROM links JOIN urls source ON source.id=links.from_url_id JOIN urls target ON target.id=links.to_url_id
+		ORDER BY links.from_url_id, links.to_url_id, links.anchor_text`
+	getLinksStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.getBigramsFreq = getBigramFreqStmt
+	store.queries.getLinks = getLinksStmt
 
-	stmt = "UPDATE frequency SET occurrences=? WHERE url_id=? AND word_id=?"
-	updateFreqStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT sentence FROM sentences WHERE url_id=? AND id>=? ORDER BY id"
+	getSentencesFromStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.updateFreq = updateFreqStmt
+	store.queries.getSentencesFrom = getSentencesFromStmt
 
-	stmt = "INSERT INTO frequency (occurrences, url_id, word_id, sentence_id) VALUES (1, ?, ?, ?)"
-	insertOccurrencesStmt, err := ebook.db.Prepare(stmt)
+	stmt = "INSERT OR REPLACE INTO skipped_urls (name, reason, detail) VALUES (?, ?, ?)"
+	insertSkippedStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.insertFreq = insertOccurrencesStmt
+	store.queries.insertSkipped = insertSkippedStmt
 
-	stmt = "INSERT INTO bigrams (occurrences, url_id, word1_id, word2_id, sentence_id) VALUES (1, ?, ?, ?, ?)"
-	insertBigramFreqStmt, err := ebook.db.Prepare(stmt)
+	stmt = `INSERT INTO url_schedule (name, lastmod, changefreq, priority) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET lastmod=excluded.lastmod, changefreq=excluded.changefreq, priority=excluded.priority`
+	upsertScheduleStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Error preparing insert statement: %v", err)
+		return storageError("could not prepare "+stmt, err)
 	}
-	ebook.queries.insertBigramsFreq = insertBigramFreqStmt
+	store.queries.upsertSchedule = upsertScheduleStmt
 
-	stmt = "UPDATE bigrams SET occurrences=? WHERE url_id=? AND word1_id=? AND word2_id=?"
-	updateBigramFreqStmt, err := ebook.db.Prepare(stmt)
+	stmt = "SELECT IFNULL(lastmod, ''), IFNULL(changefreq, ''), IFNULL(crawled_at, '') FROM url_schedule WHERE name=?"
+	getScheduleStmt, err := store.db.Prepare(stmt)
 	if err != nil {
-		log.Fatalf("Error preparing update statement: %v", err)
+		return storageError("could not prepare "+stmt, err)
+	}
+	store.queries.getSchedule = getScheduleStmt
+
+	return nil
+}
+
+// Returns the id of the row with the given name, inserting it first if it is
+// not in the table yet.
+func (store *sqliteStore) upsert(insert, find *sql.Stmt, name string) (int, error) {
+	if _, err := insert.Exec(name); err != nil {
+		return 0, storageError("could not insert "+name, err)
+	}
+	var id int
+	if err := find.QueryRow(name).Scan(&id); err != nil {
+		return 0, storageError("could not find "+name, err)
+	}
+	return id, nil
+}
+
+func (store *sqliteStore) upsertURL(url string) (int, error) {
+	return store.upsert(store.queries.insertURL, store.queries.getURLID, url)
+}
+
+func (store *sqliteStore) upsertTerm(term string) (int, error) {
+	return store.upsert(store.queries.insertWord, store.queries.getWordID, term)
+}
+
+func (store *sqliteStore) findURL(url string) (int, error) {
+	var id int
+	if err := store.queries.getURLID.QueryRow(url).Scan(&id); err != nil {
+		return 0, storageError("could not find url "+url, err)
+	}
+	return id, nil
+}
+
+func (store *sqliteStore) findTerm(term string) (int, error) {
+	var id int
+	if err := store.queries.getWordID.QueryRow(term).Scan(&id); err != nil {
+		return 0, storageError("could not find word "+term, err)
+	}
+	return id, nil
+}
+
+func (store *sqliteStore) isIndexed(urlID int) (bool, error) {
+	var indexed bool
+	if err := store.queries.isIndexed.QueryRow(indexVersion, urlID).Scan(&indexed); err != nil {
+		return false, storageError("could not check index version", err)
 	}
-	ebook.queries.updateBigramsFreq = updateBigramFreqStmt
+	return indexed, nil
+}
 
-	stmt = "SELECT COUNT(*) FROM frequency WHERE word_id=?"
-	getTotalDocsWithWordStmt, err := ebook.db.Prepare(stmt)
+func (store *sqliteStore) writePage(page *PageIndex) error {
+	tx, err := store.db.Begin()
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return storageError("could not begin transaction", err)
 	}
-	ebook.queries.getTotalDocsWithWord = getTotalDocsWithWordStmt
+	// Rolling back after a commit does nothing.
+	defer tx.Rollback()
 
-	stmt = "SELECT SUM(occurrences) FROM frequency WHERE url_id = ?"
-	getTotalUrlWordsStmt, err := ebook.db.Prepare(stmt)
+	urlID, err := store.upsert(tx.Stmt(store.queries.insertURL), tx.Stmt(store.queries.getURLID), page.url)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return err
+	}
+	// The corpus totals change by the difference between the terms the url
+	// had and the terms of the page.
+	var previousTerms int
+	err = tx.QueryRow("SELECT total_terms FROM url_stats WHERE url_id=?", urlID).Scan(&previousTerms)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return storageError("could not get url stats", err)
+	}
+	for _, table := range []string{"positions", "frequency", "bigrams", "sentences", "surface_forms", "url_stats"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE url_id=?", urlID)
+		if err != nil {
+			return storageError("could not clear "+table+" for url", err)
+		}
+	}
+	for _, table := range []string{"anchor_terms", "links"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE from_url_id=?", urlID)
+		if err != nil {
+			return storageError("could not clear "+table+" from url", err)
+		}
 	}
-	ebook.queries.getTotalUrlWords = getTotalUrlWordsStmt
 
-	stmt = "SELECT COUNT(*) FROM urls"
-	getDocCountStmt, err := ebook.db.Prepare(stmt)
+	// Sentences are added in order, so the snippets can take the sentences
+	// after them by id.
+	var sentenceRows [][]any
+	for _, sentence := range page.sentences {
+		sentenceRows = append(sentenceRows, []any{sentence, urlID})
+	}
+	if err := insertRows(tx, "sentences", []string{"sentence", "url_id"}, sentenceRows, ""); err != nil {
+		return err
+	}
+	sentenceIDs, err := selectIDs(tx, "SELECT id, sentence FROM sentences WHERE url_id=?", urlID)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return err
 	}
-	ebook.queries.getDocCount = getDocCountStmt
 
-	stmt = "SELECT url_id FROM frequency WHERE word_id = ?"
-	getAllUrlsForWordStmt, err := ebook.db.Prepare(stmt)
+	terms := make([]string, 0, len(page.terms))
+	for term := range page.terms {
+		terms = append(terms, term)
+	}
+	targetSet := make(map[string]struct{})
+	for link := range page.links {
+		targetSet[link[0]] = struct{}{}
+	}
+	for target, anchorTerms := range page.anchorTerms {
+		targetSet[target] = struct{}{}
+		for term := range anchorTerms {
+			if _, exists := page.terms[term]; !exists {
+				terms = append(terms, term)
+			}
+		}
+	}
+	termIDs, err := upsertNames(tx, "words", terms)
+	if err != nil {
+		return err
+	}
+	targets := make([]string, 0, len(targetSet))
+	for target := range targetSet {
+		targets = append(targets, target)
+	}
+	targetIDs, err := upsertNames(tx, "urls", targets)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return err
 	}
-	ebook.queries.getAllUrlsForWord = getAllUrlsForWordStmt
 
-	stmt = "SELECT url_id FROM bigrams WHERE word1_id = ? AND word2_id = ?"
-	getAllUrlsForBigramStmt, err := ebook.db.Prepare(stmt)
+	var frequencyRows [][]any
+	for term, count := range page.terms {
+		frequencyRows = append(frequencyRows, []any{urlID, termIDs[term], sentenceIDs[page.sentences[count.sentence]], count.occurrences})
+	}
+	if err := insertRows(tx, "frequency", []string{"url_id", "word_id", "sentence_id", "occurrences"}, frequencyRows, ""); err != nil {
+		return err
+	}
+	var positionRows [][]any
+	for term, count := range page.terms {
+		for _, position := range count.positions {
+			positionRows = append(positionRows, []any{termIDs[term], urlID, position.offset, sentenceIDs[page.sentences[position.sentence]], position.field})
+		}
+	}
+	if err := insertRows(tx, "positions", []string{"word_id", "url_id", "position", "sentence_id", "field"}, positionRows, ""); err != nil {
+		return err
+	}
+	var anchorRows [][]any
+	for target, anchorTerms := range page.anchorTerms {
+		for term, occurrences := range anchorTerms {
+			anchorRows = append(anchorRows, []any{termIDs[term], targetIDs[target], urlID, occurrences})
+		}
+	}
+	if err := insertRows(tx, "anchor_terms", []string{"word_id", "url_id", "from_url_id", "occurrences"}, anchorRows, ""); err != nil {
+		return err
+	}
+	var linkRows [][]any
+	for link := range page.links {
+		linkRows = append(linkRows, []any{urlID, targetIDs[link[0]], link[1]})
+	}
+	if err := insertRows(tx, "links", []string{"from_url_id", "to_url_id", "anchor_text"}, linkRows, ""); err != nil {
+		return err
+	}
+	var surfaceRows [][]any
+	for term, forms := range page.surfaceForms {
+		for form, occurrences := range forms {
+			surfaceRows = append(surfaceRows, []any{form, urlID, termIDs[term], occurrences})
+		}
+	}
+	if err := insertRows(tx, "surface_forms", []string{"form", "url_id", "word_id", "occurrences"}, surfaceRows, ""); err != nil {
+		return err
+	}
+	// Both words of a bigram are terms of the page as well.
+	var bigramRows [][]any
+	for bigram, count := range page.bigrams {
+		bigramRows = append(bigramRows, []any{urlID, termIDs[bigram[0]], termIDs[bigram[1]], sentenceIDs[page.sentences[count.sentence]], count.occurrences})
+	}
+	if err := insertRows(tx, "bigrams", []string{"url_id", "word1_id", "word2_id", "sentence_id", "occurrences"}, bigramRows, ""); err != nil {
+		return err
+	}
+
+	if _, err := tx.Stmt(store.queries.insertURLTitle).Exec(page.title, page.url); err != nil {
+		return storageError("could not add title", err)
+	}
+	if err := updateCorpusStats(tx, urlID, previousTerms, page.totalTerms()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE urls SET index_version=? WHERE id=?", indexVersion, urlID); err != nil {
+		return storageError("could not set index version", err)
+	}
+	_, err = tx.Exec(`INSERT INTO url_schedule (name, crawled_at) VALUES (?, ?)
+		ON CONFLICT(name) DO UPDATE SET crawled_at=excluded.crawled_at`, page.url, time.Now().UTC().Format(time.RFC3339))
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return storageError("could not set crawl time", err)
 	}
-	ebook.queries.getAllURLsForBigram = getAllUrlsForBigramStmt
 
-	stmt = "SELECT COUNT(*) FROM bigrams WHERE word1_id=? AND word2_id=?"
-	getTotalDocsWithBigramStmt, err := ebook.db.Prepare(stmt)
+	if err := tx.Commit(); err != nil {
+		return storageError("could not commit page", err)
+	}
+	return nil
+}
+
+// Record the amount of terms of the url, whose old stats were cleared, and
+// change the totals of the corpus by how much it changed. Only urls with
+// terms are documents.
+func updateCorpusStats(tx *sql.Tx, urlID, previousTerms, terms int) error {
+	documents := 0
+	if terms > 0 {
+		if _, err := tx.Exec("INSERT INTO url_stats (url_id, total_terms) VALUES (?, ?)", urlID, terms); err != nil {
+			return storageError("could not add url stats", err)
+		}
+		documents++
+	}
+	if previousTerms > 0 {
+		documents--
+	}
+	_, err := tx.Exec("UPDATE corpus_stats SET documents=documents+?, total_terms=total_terms+?", documents, terms-previousTerms)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return storageError("could not update corpus stats", err)
+	}
+	return nil
+}
+
+// The most rows written or looked up by a single statement, which keeps the
+// amount of variables under SQLite's limit.
+const maxBatchRows = 200
+
+// Insert the rows, a batch of them per statement. Each row holds a value for
+// each of the columns. onConflict is added to each statement when it is not
+// empty.
+func insertRows(tx *sql.Tx, table string, columns []string, rows [][]any, onConflict string) error {
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	for len(rows) > 0 {
+		batch := rows[:min(len(rows), maxBatchRows)]
+		rows = rows[len(batch):]
+
+		var args []any
+		for _, row := range batch {
+			args = append(args, row...)
+		}
+		query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES " +
+			strings.TrimSuffix(strings.Repeat(placeholders+", ", len(batch)), ", ") + " " + onConflict
+		if _, err := tx.Exec(query, args...); err != nil {
+			return storageError("could not insert into "+table+" table", err)
+		}
 	}
-	ebook.queries.getTotalDocsForBigram = getTotalDocsWithBigramStmt
+	return nil
+}
 
-	stmt = "SELECT id FROM sentences WHERE sentence=?"
-	getSentenceIDStmt, err := ebook.db.Prepare(stmt)
+// Returns the ids of the names in the words or urls table, adding the names
+// that are new.
+func upsertNames(tx *sql.Tx, table string, names []string) (map[string]int, error) {
+	ids, err := findNames(tx, table, names)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	var rows [][]any
+	for _, name := range names {
+		if _, exists := ids[name]; !exists {
+			missing = append(missing, name)
+			rows = append(rows, []any{name})
+		}
+	}
+	if err := insertRows(tx, table, []string{"name"}, rows, "ON CONFLICT(name) DO NOTHING"); err != nil {
+		return nil, err
+	}
+	added, err := findNames(tx, table, missing)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return nil, err
+	}
+	for name, id := range added {
+		ids[name] = id
+	}
+	return ids, nil
+}
+
+// Returns the ids of the names that are in the words or urls table, a batch
+// of names per query.
+func findNames(tx *sql.Tx, table string, names []string) (map[string]int, error) {
+	ids := make(map[string]int, len(names))
+	for len(names) > 0 {
+		batch := names[:min(len(names), maxBatchRows)]
+		names = names[len(batch):]
+
+		args := make([]any, len(batch))
+		for i, name := range batch {
+			args[i] = name
+		}
+		query := "SELECT id, name FROM " + table + " WHERE name IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ") + ")"
+		found, err := selectIDs(tx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for name, id := range found {
+			ids[name] = id
+		}
 	}
-	ebook.queries.getSentenceID = getSentenceIDStmt
+	return ids, nil
+}
 
-	stmt = "SELECT sentence FROM sentences WHERE id=?"
-	getSentenceStmt, err := ebook.db.Prepare(stmt)
+// Runs a query for ids and names and returns the id of each name.
+func selectIDs(tx *sql.Tx, query string, args ...any) (map[string]int, error) {
+	rows, err := tx.Query(query, args...)
 	if err != nil {
-		log.Fatalf("Could not prepare sentence select stmt: %v", err)
+		return nil, storageError("could not look up ids", err)
+	}
+	defer rows.Close()
+
+	ids := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, storageError("could not scan through all rows", err)
+		}
+		ids[name] = id
 	}
-	ebook.queries.getSentence = getSentenceStmt
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return ids, nil
+}
 
-	stmt = "SELECT sentence_id FROM frequency WHERE url_id=? AND word_id=?"
-	getFreqSentenceStmt, err := ebook.db.Prepare(stmt)
+func (store *sqliteStore) postings(termID int) ([]Posting, error) {
+	rows, err := store.queries.getPostings.Query(termID)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return nil, storageError("could not get all urls of a word", err)
 	}
-	ebook.queries.getFreqSentence = getFreqSentenceStmt
+	return scanPostings(rows)
+}
 
-	stmt = "SELECT sentence_id FROM bigrams WHERE url_id=? AND word1_id=? AND word2_id=?"
-	getBigramFreqSentenceStmt, err := ebook.db.Prepare(stmt)
+func (store *sqliteStore) bigramPostings(term1ID, term2ID int) ([]Posting, error) {
+	rows, err := store.queries.getBigramPostings.Query(term1ID, term2ID)
 	if err != nil {
-		log.Fatalf("Could not prepare statement: %v", err)
+		return nil, storageError("could not get all urls of a bigram", err)
 	}
-	ebook.queries.getBigramFreqSentence = getBigramFreqSentenceStmt
+	return scanPostings(rows)
+}
 
+// Returns the postings in the rows and closes them.
+func scanPostings(rows *sql.Rows) ([]Posting, error) {
+	defer rows.Close()
+
+	var postings []Posting
+	for rows.Next() {
+		var posting Posting
+		if err := rows.Scan(&posting.urlID, &posting.occurrences, &posting.sentenceID); err != nil {
+			return nil, storageError("could not scan through all rows", err)
+		}
+		postings = append(postings, posting)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return postings, nil
 }
 
-// Insert a unique word or url into the corresponding table.
-func (ebook *Index) addNewWordorUrl(tableName string, name string) error {
-	// First, check if the row already exists in the table
-	var exists bool
-	existsQuery := "SELECT EXISTS(SELECT 1 FROM " + tableName + " WHERE name=?)"
-	err := ebook.db.QueryRow(existsQuery, name).Scan(&exists)
+func (store *sqliteStore) positions(termID int) (map[int][]Position, error) {
+	rows, err := store.queries.getPositions.Query(termID)
 	if err != nil {
-		log.Fatalf("Error during checking for existing value: %v", err)
-		return err
+		return nil, storageError("could not get positions of a word", err)
 	}
+	defer rows.Close()
 
-	if !exists {
-		if tableName == "words" {
-			_, err := ebook.queries.insertWord.Exec(name)
-			if err != nil {
-				log.Fatalf("Could not insert word %v", err)
-			}
-		} else if tableName == "urls" {
-			_, err := ebook.queries.insertURL.Exec(name)
-			if err != nil {
-				log.Fatalf("Could not insert url %v", err)
-			}
+	positions := make(map[int][]Position)
+	for rows.Next() {
+		var urlID int
+		var position Position
+		if err := rows.Scan(&urlID, &position.offset, &position.sentence, &position.field); err != nil {
+			return nil, storageError("could not scan through all rows", err)
 		}
-		// fmt.Printf("Successfully inserted %s into the %s table.\n", name, tableName)
+		positions[urlID] = append(positions[urlID], position)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return positions, nil
+}
 
-	return nil
+func (store *sqliteStore) anchorCounts(termID int) (map[int]int, error) {
+	rows, err := store.queries.getAnchorCounts.Query(termID)
+	if err != nil {
+		return nil, storageError("could not get anchor counts of a word", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[int]int)
+	for rows.Next() {
+		var urlID, count int
+		if err := rows.Scan(&urlID, &count); err != nil {
+			return nil, storageError("could not scan through all rows", err)
+		}
+		counts[urlID] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return counts, nil
 }
 
-// Find the id of the selected word or url.
-func (ebook *Index) findID(tableName string, name string) int {
-	var id int
-	if tableName == "words" {
-		err := ebook.queries.getWordID.QueryRow(name).Scan(&id)
-		if err != nil {
-			return 0
+func (store *sqliteStore) docStats(urlIDs []int) (map[int]DocStats, error) {
+	stats := make(map[int]DocStats, len(urlIDs))
+	for len(urlIDs) > 0 {
+		batch := urlIDs[:min(len(urlIDs), maxBatchRows)]
+		urlIDs = urlIDs[len(batch):]
+		if err := store.readDocStats(batch, stats); err != nil {
+			return nil, err
 		}
-	} else if tableName == "urls" {
-		err := ebook.queries.getURLID.QueryRow(name).Scan(&id)
-		if err != nil {
-			return 0
+		for _, urlID := range batch {
+			if _, exists := stats[urlID]; !exists {
+				return nil, storageError("could not find url", ErrNotFound)
+			}
 		}
-	} else if tableName == "sentences" {
-		err := ebook.queries.getSentenceID.QueryRow(name).Scan(&id)
-		if err != nil {
-			return 0
+	}
+	return stats, nil
+}
+
+// Read the stats of a batch of urls into stats with a single query.
+func (store *sqliteStore) readDocStats(urlIDs []int, stats map[int]DocStats) error {
+	args := make([]any, len(urlIDs))
+	for i, urlID := range urlIDs {
+		args[i] = urlID
+	}
+	rows, err := store.db.Query(`SELECT urls.id, urls.name, IFNULL(urls.title, ''), IFNULL(authority.score, 1), IFNULL(url_stats.total_terms, 0)
+		FROM urls LEFT JOIN authority ON authority.url_id=urls.id LEFT JOIN url_stats ON url_stats.url_id=urls.id
+		WHERE urls.id IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(urlIDs)), ", ")+")", args...)
+	if err != nil {
+		return storageError("could not get url stats", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var urlID int
+		var urlStats DocStats
+		if err := rows.Scan(&urlID, &urlStats.url, &urlStats.title, &urlStats.authority, &urlStats.totalTerms); err != nil {
+			return storageError("could not scan through all rows", err)
 		}
+		stats[urlID] = urlStats
 	}
-	return id
+	if err := rows.Err(); err != nil {
+		return storageError("could not scan through all rows", err)
+	}
+	return nil
 }
 
-func (ebook *Index) getWord(wordID int) string {
-	var word string
-	err := ebook.queries.getWord.QueryRow(wordID).Scan(&word)
+func (store *sqliteStore) documentCount() (int, error) {
+	var count int
+	if err := store.queries.getDocCount.QueryRow().Scan(&count); err != nil {
+		return 0, storageError("could not count document table", err)
+	}
+	return count, nil
+}
+
+func (store *sqliteStore) links() ([]Link, error) {
+	rows, err := store.queries.getLinks.Query()
 	if err != nil {
-		log.Fatalf("Error getting word: %v", err)
+		return nil, storageError("could not get links", err)
 	}
+	defer rows.Close()
 
-	return word
+	var links []Link
+	for rows.Next() {
+		var link Link
+		if err := rows.Scan(&link.fromID, &link.toID, &link.from, &link.to, &link.anchorText); err != nil {
+			return nil, storageError("could not scan through all rows", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return links, nil
 }
 
-// Insert a new row of occurrences or update the amount of occurrences for an
-// existing word.
-func (ebook *Index) addOccurrence(urlID int, word, sentence string) error {
-	wordID := ebook.findID("words", word)
-	sentenceID := ebook.findID("sentences", sentence)
-	// For testing purposes
-	// url := ebook.getURL(urlID)
+func (store *sqliteStore) setAuthority(authority map[int]float64) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return storageError("could not begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM authority"); err != nil {
+		return storageError("could not clear authority", err)
+	}
+	var rows [][]any
+	for urlID, score := range authority {
+		rows = append(rows, []any{urlID, score})
+	}
+	if err := insertRows(tx, "authority", []string{"url_id", "score"}, rows, ""); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return storageError("could not commit authority", err)
+	}
+	return nil
+}
 
-	// Check if the row already exists in the frequency table
-	var hits int
-	err := ebook.queries.getFreq.QueryRow(urlID, wordID).Scan(&hits)
+func (store *sqliteStore) totalTerms() (int, error) {
+	var count int
+	if err := store.queries.getTotalWords.QueryRow().Scan(&count); err != nil {
+		return 0, storageError("could not count total words", err)
+	}
+	return count, nil
+}
 
+func (store *sqliteStore) vocabulary() (map[string]int, error) {
+	rows, err := store.queries.getVocabulary.Query()
 	if err != nil {
-		// If the word does not exist on the current url, create a new row for the new entry.
-		if err == sql.ErrNoRows {
-			_, err = ebook.queries.insertFreq.Exec(urlID, wordID, sentenceID)
-			if err != nil {
-				log.Fatalf("Could not insert into frequency table %v", err)
-				return err
-			}
-			// Only noting the first sentence in the url the word was found on
-			// fmt.Println("Word: " + word + " Sentence: " + sentence)
-			// fmt.Printf("Successfully added occurrence with values (Occurrences: 1, url: %s, word: %s)\n", url, word)
+		return nil, storageError("could not get vocabulary", err)
+	}
+	defer rows.Close()
+
+	vocabulary := make(map[string]int)
+	for rows.Next() {
+		var term string
+		var urls int
+		if err := rows.Scan(&term, &urls); err != nil {
+			return nil, storageError("could not scan through all rows", err)
 		}
-	} else {
-		// If the word does exist on the current url, increment its amount of occurrences.
-		hits++
-		_, err = ebook.queries.updateFreq.Exec(hits, urlID, wordID)
-		if err != nil {
-			log.Fatalf("Could not update frequency table %v", err)
-			return err
+		vocabulary[term] = urls
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return vocabulary, nil
+}
+
+func (store *sqliteStore) bigramVocabulary() (map[[2]string]int, error) {
+	rows, err := store.queries.getBigramVocab.Query()
+	if err != nil {
+		return nil, storageError("could not get bigram vocabulary", err)
+	}
+	defer rows.Close()
+
+	vocabulary := make(map[[2]string]int)
+	for rows.Next() {
+		var bigram [2]string
+		var urls int
+		if err := rows.Scan(&bigram[0], &bigram[1], &urls); err != nil {
+			return nil, storageError("could not scan through all rows", err)
 		}
-		// fmt.Printf("Successfully updated occurrence to %d for URL: %s and Word: %s\n", hits, url, word)
+		vocabulary[bigram] = urls
 	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return vocabulary, nil
+}
 
-	return nil
+func (store *sqliteStore) matchSurfaceForms(pattern string, limit int) ([]SurfaceForm, error) {
+	// A [ starts a set of characters in GLOB, so it is matched as one.
+	pattern = strings.ReplaceAll(pattern, "[", "[[]")
+	return store.surfaceForms(store.queries.getSurfaceMatches, pattern, limit)
 }
 
-func (ebook *Index) addTitle(title string, url string) {
-	_, err := ebook.queries.insertURLTitle.Exec(title, url)
+func (store *sqliteStore) commonSurfaceForms() (map[string]string, error) {
+	forms, err := store.surfaceForms(store.queries.getSurfaceForms)
 	if err != nil {
-		log.Fatalf("Could not add title: %v", err)
+		return nil, err
 	}
-	fmt.Println("Setting title: " + title + " for url: " + url)
+	return mostCommonForms(forms), nil
 }
 
-func (ebook *Index) addSentence(sentence string, urlID int) {
-	insertQuery := "INSERT INTO sentences (sentence, url_id) VALUES (?, ?)"
-	insertStmt, err := ebook.db.Prepare(insertQuery)
+// Returns the surface forms selected by the statement with the arguments.
+func (store *sqliteStore) surfaceForms(stmt *sql.Stmt, args ...any) ([]SurfaceForm, error) {
+	rows, err := stmt.Query(args...)
 	if err != nil {
-		log.Fatalf("Error preparing insert statement: %v", err)
+		return nil, storageError("could not get surface forms", err)
 	}
-	defer insertStmt.Close()
+	defer rows.Close()
 
-	// fmt.Println("Inserting sentence:" + sentence + " into table at: " + url)
-	insertStmt.Exec(sentence, urlID)
+	var forms []SurfaceForm
+	for rows.Next() {
+		var form SurfaceForm
+		if err := rows.Scan(&form.form, &form.term, &form.documents); err != nil {
+			return nil, storageError("could not scan through all rows", err)
+		}
+		forms = append(forms, form)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, storageError("could not scan through all rows", err)
+	}
+	return forms, nil
 }
 
-// Check if either half of the bigram is a stopword - if not stem both.
-func (ebook *Index) validateAndStemBigram(word1 string, word2 string) (string, string) {
-	if stemmedWord1, err := snowball.Stem(word1, "english", true); err == nil {
-		if _, exists := StopWords[stemmedWord1]; !exists {
-			if stemmedWord2, err := snowball.Stem(word2, "english", true); err == nil {
-				if _, exists := StopWords[stemmedWord2]; !exists {
-					return stemmedWord1, stemmedWord2
-				}
-			}
+func (store *sqliteStore) snippet(urlID, sentenceID, minLength int) (string, error) {
+	rows, err := store.queries.getSentencesFrom.Query(urlID, sentenceID)
+	if err != nil {
+		return "", storageError("could not find sentence", err)
+	}
+	defer rows.Close()
+
+	var sentences []string
+	length := 0
+	for length < minLength && rows.Next() {
+		var sentence string
+		if err := rows.Scan(&sentence); err != nil {
+			return "", storageError("could not scan through all rows", err)
 		}
+		sentences = append(sentences, sentence)
+		length += len(sentence) + 1
+	}
+	if err := rows.Err(); err != nil {
+		return "", storageError("could not scan through all rows", err)
 	}
-	return "", ""
+	if len(sentences) == 0 {
+		return "", storageError("could not find sentence", sql.ErrNoRows)
+	}
+	return strings.Join(sentences, " "), nil
 }
 
-func (ebook *Index) insertBigram(word1, word2, sentence string, urlID int) {
-	stemmedWord1, stemmedWord2 := ebook.validateAndStemBigram(word1, word2)
-	if stemmedWord1 != "" {
-		// No need for error handling because these words will always exist in table.
-		word1ID, word2ID := ebook.findID("words", stemmedWord1), ebook.findID("words", stemmedWord2)
-		sentenceID := ebook.findID("sentences", sentence)
-		// fmt.Println("Word 1 id: " + fmt.Sprintf("%d", word1ID))
-		// fmt.Println("Word 2 id: " + fmt.Sprintf("%d", word2ID))
+func (store *sqliteStore) addSkipped(url, reason, detail string) error {
+	_, err := store.queries.insertSkipped.Exec(url, reason, detail)
+	if err != nil {
+		return storageError("could not add skipped url", err)
+	}
+	return nil
+}
 
-		// Check if the row already exists in the frequency table
-		var hits int
-		err := ebook.queries.getBigramsFreq.QueryRow(urlID, word1ID, word2ID).Scan(&hits)
+func (store *sqliteStore) addSchedule(url, lastmod, changefreq string, priority float64) error {
+	_, err := store.queries.upsertSchedule.Exec(url, lastmod, changefreq, priority)
+	if err != nil {
+		return storageError("could not add sitemap entry", err)
+	}
+	return nil
+}
 
+func (store *sqliteStore) getSchedule(url string) (lastmod, changefreq, crawledAt string, err error) {
+	err = store.queries.getSchedule.QueryRow(url).Scan(&lastmod, &changefreq, &crawledAt)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", "", storageError("could not get crawl schedule", err)
+	}
+	return lastmod, changefreq, crawledAt, nil
+}
+
+// Returns the amount of rows in each table.
+func (store *sqliteStore) stats() ([]StoreStat, error) {
+	var stats []StoreStat
+	for _, table := range []string{"urls", "words", "sentences", "frequency", "bigrams", "positions", "anchor_terms", "links", "authority", "url_stats", "skipped_urls", "url_schedule"} {
+		var count int
+		err := store.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
 		if err != nil {
-			// If the bigram does not exist on the current url, create a new row for the new entry.
-			if err == sql.ErrNoRows {
-				_, err = ebook.queries.insertBigramsFreq.Exec(urlID, word1ID, word2ID, sentenceID)
-				if err != nil {
-					log.Fatalf("Could not insert into bigrams table %v", err)
-				}
-				// fmt.Printf("Successfully added occurrence with values (Occurrences: 1, url: %s, words: %s %s)\n", url, stemmedWord1, stemmedWord2)
-			}
-		} else {
-			// If the bigram does exist on the current url, increment its amount of occurrences.
-			hits++
-			_, err = ebook.queries.updateBigramsFreq.Exec(hits, urlID, word1ID, word2ID)
-			if err != nil {
-				log.Fatalf("Could not update bigrams table %v", err)
-			}
-			// fmt.Printf("Successfully updated occurrence to %d for URL: %s and Words: %s %s\n", hits, url, stemmedWord1, stemmedWord2)
+			return nil, storageError("could not count rows in "+table, err)
 		}
+		stats = append(stats, StoreStat{name: table, count: count})
 	}
+	return stats, nil
+}
+
+func (store *sqliteStore) close() error {
+	return store.db.Close()
 }
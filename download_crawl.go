@@ -1,180 +1,359 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"regexp"
+	"net"
+	"net/url"
 	"strings"
 	"sync"
-	"time"
 	"unicode"
 
 	"github.com/kljensen/snowball"
 )
 
 type DownloadResult struct {
-	body []byte
-	err  error
+	item        frontierItem
+	body        []byte
+	contentType string
+	err         error
 }
 
 type ExtractResult struct {
+	item             frontierItem
 	hrefs, sentences []string
-	title            string
+	// The field of each sentence. Sentences past the end are body text.
+	fields      []Field
+	anchors     []Anchor
+	title, base string
+	err         error
 }
 
-func (ebook *Index) downloadDatabase(url string, dlOutC chan DownloadResult) {
-	ebook.mu.Lock()
-	// fmt.Println("Now downloading " + url)
-	delay := time.Duration(ebook.robots[".*"].delay)
-	// If delay was not set, set to 100ms.
-	if delay == 0 {
-		delay = 100
+// An Anchor is a link along with its text.
+type Anchor struct {
+	href, text string
+}
+
+// Add the sentences, tagged with the field they come from.
+func (result *ExtractResult) addSentences(field Field, sentences ...string) {
+	for len(result.fields) < len(result.sentences) {
+		result.fields = append(result.fields, bodyField)
+	}
+	result.sentences = append(result.sentences, sentences...)
+	for range sentences {
+		result.fields = append(result.fields, field)
+	}
+}
+
+// Returns the field of the i-th sentence.
+func (result *ExtractResult) sentenceField(i int) Field {
+	if i < len(result.fields) {
+		return result.fields[i]
 	}
+	return bodyField
+}
+
+// Reasons recorded in the skipped_urls table for pages that were not crawled.
+const (
+	skipRobots     = "robots-disallowed"
+	skipFetchError = "fetch-error"
+	skipTimeout    = "timeout"
+	skipHTTPStatus = "http-status"
+	skipParse      = "parse-error"
+	skipType       = "unsupported-content-type"
+)
+
+// Returned by the fetcher for responses without a 2xx status code.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.code)
+}
+
+// Index an extracted page, then queue the links it contains one level
+// deeper.
+func (ebook *Index) indexPage(ex ExtractResult) error {
+	url := ex.item.url
 	// create the row for the current url
-	ebook.addNewWordorUrl("urls", url)
-	time.Sleep(delay * time.Millisecond)
-
-	// get the contents of a given URL and return a slice of bytes
-	if rsp, err := http.Get(url); err == nil {
-		if bts, err := io.ReadAll(rsp.Body); err == nil {
-			// Put the results from download into the download output channel
-			dlOutC <- DownloadResult{body: bts, err: nil}
-		}
-	}
-	ebook.mu.Unlock()
-}
-
-func (ebook *Index) recursiveCrawlDatabase(url string, crawledUrls *map[string]struct{}, wg *sync.WaitGroup) {
-	// Add the current goroutine to the waitgroup
-	wg.Add(1)
-	// Creating channels to store the input/output of functions
-	dlInC := make(chan string, 10000)
-	dlOutC := make(chan DownloadResult, 10000)
-	exOutC := make(chan ExtractResult, 10000)
-	// Timeout channel to know when to stop crawling
-	// Time was reduced until values were no longer consistent
-	timeout := time.After(1 * time.Second)
-
-	// Put the current url into the download input channel.
-	dlInC <- url
-
-	var valid bool
-	for _, disallowedUrl := range ebook.robots[".*"].disallowed {
-		if matched, err := regexp.MatchString(disallowedUrl, url); err == nil {
-			if matched {
-				// fmt.Println(url, "is not allowed.")
-				valid = false
-				break
-			} else {
-				// fmt.Println(url, "is allowed")
-				valid = true
-				(*crawledUrls)[url] = struct{}{}
-			}
+	urlID, err := ebook.store.upsertURL(url)
+	if err != nil {
+		return err
+	}
+	exists, err := ebook.store.isIndexed(urlID)
+	if err != nil {
+		return err
+	}
+
+	// If the current url is already indexed, do not crawl its words again
+	// unless its sitemap says it is due.
+	if exists {
+		due, err := ebook.dueForRecrawl(url)
+		if err != nil {
+			return err
+		}
+		if due {
+			fmt.Println(url, "changed, indexing it again.")
+			exists = false
 		}
 	}
+	if !exists {
+		if err := ebook.store.writePage(ebook.countPage(ex)); err != nil {
+			return err
+		}
+		fmt.Println("Setting title: " + ex.title + " for url: " + url)
+	} else {
+		fmt.Println(url, "already exists.")
+	}
 
-	for _, allowedUrl := range ebook.robots[".*"].allowed {
-		if matched, err := regexp.MatchString(allowedUrl, url); err == nil {
-			if matched {
-				valid = true
-				(*crawledUrls)[url] = struct{}{}
-				break
-			} else {
-				valid = false
-			}
+	// Only follow the links on this page when recursion is enabled.
+	if ebook.config.recursive {
+		ebook.followLinks(ex)
+	}
+	return nil
+}
+
+// Queue the links of the page one level deeper than the page itself.
+func (ebook *Index) followLinks(ex ExtractResult) {
+	base, err := ex.baseURL()
+	if err != nil {
+		return
+	}
+	for _, href := range ex.hrefs {
+		if link, ok := ebook.linkTarget(base, href); ok {
+			ebook.frontier.push(link, ex.item.depth+1, defaultPriority)
 		}
 	}
+}
 
-	go func() {
-		for {
-			select {
-			case url := <-dlInC:
-				// fmt.Println("Downloading...")
-				valid = true
-				if valid {
-					ebook.downloadDatabase(url, dlOutC)
-				}
-			case dl := <-dlOutC:
-				// fmt.Println("Extracting...")
-				extract(&dl, exOutC)
-			case ex := <-exOutC:
-				var exists bool
-				urlID := ebook.findID("urls", url)
-				err := ebook.db.QueryRow("SELECT EXISTS(SELECT 1 FROM frequency WHERE url_id=?)", urlID).Scan(&exists)
-				if err != nil {
-					log.Fatalf("Error in checking for existing row %v", err)
-				}
+// Returns the url that relative links on the page are resolved against.
+func (ex ExtractResult) baseURL() (*url.URL, error) {
+	base, err := url.Parse(ex.item.url)
+	if err != nil {
+		return nil, err
+	}
+	if ex.base != "" {
+		if baseHref, err := base.Parse(ex.base); err == nil {
+			base = baseHref
+		}
+	}
+	return base, nil
+}
 
-				// If the current url already exists in the frequency table,
-				// do not crawl its words again.
-				if !exists {
-					var currentWords []string
-					currentUrlID := ebook.findID("urls", url)
-					for _, sentence := range ex.sentences {
-						// fmt.Println("Current sentence:" + sentence)
-						ebook.addSentence(sentence, currentUrlID)
-						currentWords = strings.FieldsFunc(sentence, func(r rune) bool {
-							return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-						})
-						for _, word := range currentWords {
-							ebook.updateDatabase(word, sentence, currentUrlID)
-						}
-						for i := 0; i < len(currentWords)-1; i++ {
-							// fmt.Println(ex.words[i] + " " + ex.words[i+1])
-							ebook.insertBigram(currentWords[i], currentWords[i+1], sentence, currentUrlID)
-						}
-					}
-					ebook.addTitle(ex.title, url)
-				} else {
-					fmt.Println(url, "already exists.")
+// Returns the cleaned url of the link, and whether it is a page that would
+// be crawled.
+func (ebook *Index) linkTarget(base *url.URL, href string) (string, bool) {
+	cleanedUrl, err := clean(base, href, ebook.config.stripTracking)
+	if err != nil || !isPageURL(cleanedUrl) {
+		return "", false
+	}
+	// Unless told otherwise, stay on the host of the page.
+	if ebook.config.sameHost {
+		if linkUrl, err := url.Parse(cleanedUrl); err != nil || linkUrl.Host != base.Host {
+			return "", false
+		}
+	}
+	return cleanedUrl, true
+}
+
+// Count the terms and bigrams of every sentence of the page, and collect its
+// links to other pages along with the terms of their text. Terms are
+// stemmed, and stopwords are left out.
+func (ebook *Index) countPage(ex ExtractResult) *PageIndex {
+	page := newPageIndex(ex.item.url, ex.title)
+	var currentWords []string
+	// The token offset of the current word within the page.
+	offset := 0
+	for i, sentence := range ex.sentences {
+		// fmt.Println("Current sentence:" + sentence)
+		sentenceIndex := page.addSentence(sentence)
+		field := ex.sentenceField(i)
+		currentWords = splitWords(sentence)
+		for _, word := range currentWords {
+			if stemmedWord, err := snowball.Stem(word, "english", true); err == nil {
+				// If the stemmed word is not in the stopword map, then add it.
+				if _, exists := StopWords[stemmedWord]; !exists {
+					page.addTerm(stemmedWord, offset, sentenceIndex, field)
+					page.addSurfaceForm(strings.ToLower(word), stemmedWord)
 				}
+			}
+			offset++
+		}
+		for i := 0; i < len(currentWords)-1; i++ {
+			// fmt.Println(ex.words[i] + " " + ex.words[i+1])
+			stemmedWord1, stemmedWord2 := ebook.validateAndStemBigram(currentWords[i], currentWords[i+1])
+			if stemmedWord1 != "" {
+				page.addBigram(stemmedWord1, stemmedWord2, sentenceIndex)
+			}
+		}
+	}
 
-				// Commenting out crawling functionality
-				// for _, currentUrl := range ex.hrefs {
-				// 	cleanedUrl := clean(url, currentUrl)
-				// 	if cleanedUrl != "error" {
-				// 		crawled := false
-				// 		if _, exists := (*crawledUrls)[cleanedUrl]; exists {
-				// 			crawled = true
-				// 			break
-				// 		}
-				// 		if !crawled {
-				// 			ebook.recursiveCrawlDatabase(cleanedUrl, crawledUrls, wg)
-				// 		}
-				// 	}
-				// }
-			case <-timeout:
-				// fmt.Println("Leaving.")
-				// Only close the waitgroup after the timeout
-				defer wg.Done()
-				return
+	base, err := ex.baseURL()
+	if err != nil {
+		return page
+	}
+	anchorHrefs := make(map[string]struct{}, len(ex.anchors))
+	for _, anchor := range ex.anchors {
+		anchorHrefs[anchor.href] = struct{}{}
+		// Links to the page itself say nothing about it to others.
+		target, ok := ebook.linkTarget(base, anchor.href)
+		if !ok || target == page.url {
+			continue
+		}
+		page.addLink(target, anchor.text)
+		for _, word := range splitWords(anchor.text) {
+			if stemmedWord, err := snowball.Stem(word, "english", true); err == nil {
+				if _, exists := StopWords[stemmedWord]; !exists {
+					page.addAnchorTerm(target, stemmedWord)
+				}
 			}
 		}
-	}()
+	}
+	// Links without text, such as those of feeds and sitemaps.
+	for _, href := range ex.hrefs {
+		if _, exists := anchorHrefs[href]; exists {
+			continue
+		}
+		if target, ok := ebook.linkTarget(base, href); ok && target != page.url {
+			page.addLink(target, "")
+		}
+	}
+	return page
+}
+
+// Split the text into words on everything that is not a letter or a number.
+func splitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
 }
 
-func (ebook *Index) updateDatabase(word, sentence string, urlID int) {
-	if stemmedWord, err := snowball.Stem(word, "english", true); err == nil {
-		// If the stemmed word is not in the stopword map, then add it.
-		if _, exists := StopWords[stemmedWord]; !exists {
-			ebook.addNewWordorUrl("words", stemmedWord)
-			ebook.addOccurrence(urlID, stemmedWord, sentence)
+// Check if either half of the bigram is a stopword - if not stem both.
+func (ebook *Index) validateAndStemBigram(word1 string, word2 string) (string, string) {
+	if stemmedWord1, err := snowball.Stem(word1, "english", true); err == nil {
+		if _, exists := StopWords[stemmedWord1]; !exists {
+			if stemmedWord2, err := snowball.Stem(word2, "english", true); err == nil {
+				if _, exists := StopWords[stemmedWord2]; !exists {
+					return stemmedWord1, stemmedWord2
+				}
+			}
 		}
 	}
+	return "", ""
 }
 
-func (ebook *Index) crawlDatabase(hostUrl string) {
-	crawledUrls := make(map[string]struct{})
-	var wg sync.WaitGroup
-	wg.Add(1)
+// Record why the page was not crawled.
+func (ebook *Index) abandon(url string, err error) error {
+	reason := skipFetchError
+	var status statusError
+	var netErr net.Error
+	var unsupported unsupportedTypeError
+	if errors.Is(err, errRobotsDisallowed) {
+		reason = skipRobots
+	} else if errors.As(err, &unsupported) {
+		reason = skipType
+	} else if errors.Is(err, ErrParse) {
+		reason = skipParse
+	} else if errors.As(err, &status) {
+		reason = skipHTTPStatus
+	} else if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		reason = skipTimeout
+	}
+	fmt.Println("Skipping", url+":", err)
+	return ebook.store.addSkipped(url, reason, err.Error())
+}
 
+// Start n workers that extract every download received on in and send the
+// results on out. out is closed once in is closed and the workers are done.
+func startExtractors(n int, in <-chan DownloadResult, out chan<- ExtractResult) {
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for dl := range in {
+				// Failed downloads are passed along so that they can be recorded.
+				if dl.err != nil {
+					out <- ExtractResult{item: dl.item, err: dl.err}
+					continue
+				}
+				ex, err := extract(&dl)
+				ex.item, ex.err = dl.item, err
+				out <- ex
+			}
+		}()
+	}
 	go func() {
-		defer wg.Done()
-		ebook.recursiveCrawlDatabase(hostUrl, &crawledUrls, &wg)
+		wg.Wait()
+		close(out)
 	}()
+}
+
+// Crawl the given url along with everything else waiting in the frontier.
+// Pages are downloaded by the fetcher and extracted by their own workers
+// while this goroutine indexes them. Returns once the frontier is empty and
+// every page taken from it was either indexed or abandoned. If the index
+// cannot be written, no more pages are sent to the workers and the error is
+// returned once the pages already sent are done.
+func (ebook *Index) crawlDatabase(hostUrl string) error {
+	if seedUrl, err := clean(nil, hostUrl, ebook.config.stripTracking); err == nil {
+		ebook.frontier.push(seedUrl, 0, defaultPriority)
+	} else {
+		fmt.Println("Skipping seed", hostUrl+":", err)
+	}
 
-	wg.Wait()
-	fmt.Println("Finished crawling " + hostUrl)
+	dlInC := make(chan frontierItem)
+	dlOutC := make(chan DownloadResult)
+	exOutC := make(chan ExtractResult)
+	ebook.fetcher.start(dlInC, dlOutC)
+	startExtractors(ebook.fetcher.workers, dlOutC, exOutC)
+	defer close(dlInC)
+
+	var next frontierItem
+	hasNext := false
+	// The amount of urls that are being downloaded or extracted.
+	pending := 0
+	indexed, disallowed, abandoned := 0, 0, 0
+	var crawlErr error
+	for {
+		if !hasNext && crawlErr == nil {
+			next, hasNext = ebook.frontier.pop()
+		}
+		if (!hasNext || crawlErr != nil) && pending == 0 {
+			break
+		}
+
+		// Only offer the next url to the workers when there is one.
+		var send chan<- frontierItem
+		if hasNext && crawlErr == nil {
+			send = dlInC
+		}
+		select {
+		case send <- next:
+			hasNext = false
+			pending++
+		case ex := <-exOutC:
+			pending--
+			if crawlErr != nil {
+				continue
+			}
+			if errors.Is(ex.err, errRobotsDisallowed) {
+				crawlErr = ebook.abandon(ex.item.url, ex.err)
+				disallowed++
+			} else if ex.err != nil {
+				crawlErr = ebook.abandon(ex.item.url, ex.err)
+				abandoned++
+			} else {
+				crawlErr = ebook.indexPage(ex)
+				indexed++
+			}
+		}
+	}
+	if crawlErr != nil {
+		return fmt.Errorf("stopped crawling %s: %w", hostUrl, crawlErr)
+	}
+	fmt.Printf("Finished crawling %s: %d pages indexed, %d disallowed by robots.txt, %d abandoned\n", hostUrl, indexed, disallowed, abandoned)
+	return nil
 }
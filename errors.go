@@ -0,0 +1,27 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// The kinds of errors returned by the indexer. Errors are wrapped around one
+// of these, so callers can tell them apart with errors.Is.
+var (
+	// ErrNotFound means a url, word or sentence is not in the index.
+	ErrNotFound = errors.New("not found")
+	// ErrStorage means the database could not be read or written.
+	ErrStorage = errors.New("storage error")
+	// ErrParse means a page or a query could not be understood.
+	ErrParse = errors.New("could not parse")
+)
+
+// Wrap an error returned by a store. sql.ErrNoRows and ErrNotFound become
+// ErrNotFound and everything else becomes ErrStorage.
+func storageError(action string, err error) error {
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%s: %w", action, ErrNotFound)
+	}
+	return fmt.Errorf("%s: %w: %v", action, ErrStorage, err)
+}
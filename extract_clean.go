@@ -2,28 +2,32 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"errors"
+	"fmt"
 	"net/url"
+	"path"
 	"strings"
 
 	"golang.org/x/net/html"
-	"gopkg.in/neurosnap/sentences.v1/english"
 )
 
-func extract(exInC *DownloadResult, exOutC chan ExtractResult) {
+// Extract the title, links and sentences of an HTML page. Sentences are
+// tagged with the field they are in, and the meta description is indexed as
+// a sentence of its own.
+func parseHTML(body []byte) (ExtractResult, error) {
 	var result ExtractResult
 
-	reader := bytes.NewReader(exInC.body)
+	reader := bytes.NewReader(body)
 
-	tokenizer, err := english.NewSentenceTokenizer(nil)
+	splitSentences, err := newSentenceSplitter()
 	if err != nil {
-		panic(err)
+		return result, err
 	}
 
 	// Parse the HTML content
 	doc, err := html.Parse(reader)
 	if err != nil {
-		log.Fatalf("Could not parse html %v", err)
+		return result, err
 	}
 
 	var f func(*html.Node)
@@ -32,24 +36,32 @@ func extract(exInC *DownloadResult, exOutC chan ExtractResult) {
 		case html.ElementNode:
 			for _, attr := range n.Attr {
 				if attr.Key == "href" {
-					result.hrefs = append(result.hrefs, attr.Val)
+					// The first <base href> replaces the page url when
+					// resolving relative links.
+					if n.Data == "base" {
+						if result.base == "" {
+							result.base = attr.Val
+						}
+					} else {
+						result.hrefs = append(result.hrefs, attr.Val)
+					}
 				}
 			}
 			// Extracting the title name
-			if n.Data == "title" && n.Parent.Data == "head" {
+			if n.Data == "title" && n.Parent.Data == "head" && n.FirstChild != nil {
 				// fmt.Println("Current url title:" + strings.TrimSpace(n.FirstChild.Data))
 				result.title = strings.TrimSpace(n.FirstChild.Data)
 			}
+			if n.Data == "meta" && strings.EqualFold(attribute(n, "name"), "description") {
+				result.addSentences(descriptionField, splitSentences(attribute(n, "content"))...)
+			}
+			if href := attribute(n, "href"); n.Data == "a" && href != "" {
+				result.anchors = append(result.anchors, Anchor{href: href, text: htmlNodeText(n)})
+			}
 		case html.TextNode:
 			p := n.Parent
 			if p.Type == html.ElementNode && (p.Data != "style" && p.Data != "script") {
-
-				sentences := tokenizer.Tokenize(strings.TrimSpace(n.Data))
-
-				for _, s := range sentences {
-					result.sentences = append(result.sentences, s.Text)
-					// fmt.Println(s.Text)
-				}
+				result.addSentences(textField(n), splitSentences(n.Data)...)
 			}
 		}
 		// go through the child nodes recursively
@@ -59,59 +71,149 @@ func extract(exInC *DownloadResult, exOutC chan ExtractResult) {
 	}
 	f(doc)
 
-	// Put the results into the extract output channel
-	exOutC <- result
+	return result, nil
 }
 
-func clean(host string, href string) string {
-	var err error
+// Returns the value of the attribute of the element, or "" when it has none.
+func attribute(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
 
-	if len(href) == 0 {
-		return "error"
+// Returns the field of the text node from the elements it is in.
+func textField(n *html.Node) Field {
+	for p := n.Parent; p != nil; p = p.Parent {
+		switch p.Data {
+		case "title":
+			return titleField
+		case "h1", "h2", "h3", "h4", "h5", "h6":
+			return headingField
+		}
 	}
+	return bodyField
+}
 
-	// If the link has backslash at the end, remove it for concatenation later
-	if href[len(href)-1] == '/' {
-		href = href[:len(href)-1]
+// Returns the text inside the element, with its whitespace collapsed.
+func htmlNodeText(n *html.Node) string {
+	var text strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+			text.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
 	}
+	walk(n)
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// Query parameters that only track where a visitor came from. They are
+// removed so that the same page is not crawled once per campaign.
+var trackingParams = map[string]struct{}{
+	"gclid":   {},
+	"dclid":   {},
+	"fbclid":  {},
+	"msclkid": {},
+	"mc_cid":  {},
+	"mc_eid":  {},
+	"_ga":     {},
+	"_gl":     {},
+	"yclid":   {},
+}
+
+// Links to files with these extensions are never crawled.
+var skippedExtensions = map[string]struct{}{
+	".jpg": {}, ".jpeg": {}, ".png": {}, ".gif": {}, ".webp": {}, ".svg": {}, ".ico": {},
+	".css": {}, ".js": {}, ".woff": {}, ".woff2": {}, ".ttf": {},
+	".mp3": {}, ".mp4": {}, ".avi": {}, ".mov": {}, ".webm": {},
+	".zip": {}, ".gz": {}, ".tar": {}, ".exe": {}, ".dmg": {}, ".iso": {},
+	".ds_store": {},
+}
 
-	// I cannot figure out how to delete DS_Store.
-	if strings.Contains(href, "DS_Store") {
-		return "error"
+// Resolve the href against the base url (RFC 3986) and return it in its
+// canonical form: a lower-case scheme and host, no default port, no
+// fragment, no dot segments and a path of at least "/". A nil base means href
+// must already be absolute. Tracking parameters are removed when
+// stripTracking is set.
+func clean(base *url.URL, href string, stripTracking bool) (string, error) {
+	href = strings.TrimSpace(href)
+	if href == "" {
+		return "", errors.New("empty url")
 	}
 
-	if hostUrl, err := url.Parse(host); err == nil {
-		if parsedUrl, err := url.Parse(href); err == nil {
-			// If the link starts with a backslash (is part of a complete link)
-			// then just add the hostUrl's scheme and host
-			if len(href) != 0 && href[0] == '/' {
-				parsedUrl.Scheme = hostUrl.Scheme
-				parsedUrl.Host = hostUrl.Host
-				return parsedUrl.String()
-			}
+	parsedUrl, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	if base == nil {
+		// Resolving an absolute url against itself removes its dot segments.
+		base = parsedUrl
+	}
+	parsedUrl = base.ResolveReference(parsedUrl)
 
-			// Do not crawl pictures.
-			if strings.Contains(href, "jpg") || strings.Contains(href, "png") {
-				return "error"
-			}
+	parsedUrl.Scheme = strings.ToLower(parsedUrl.Scheme)
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme in %q", href)
+	}
+	if parsedUrl.Host == "" {
+		return "", fmt.Errorf("no host in %q", href)
+	}
 
-			// if it is an incomplete url (html file), add it to the host URL
-			if parsedUrl.Scheme == "" && parsedUrl.Path != "" {
-				return host + "/" + parsedUrl.String()
-			}
+	host := strings.ToLower(parsedUrl.Hostname())
+	port := parsedUrl.Port()
+	if (parsedUrl.Scheme == "http" && port == "80") || (parsedUrl.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literals keep their brackets.
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	parsedUrl.Host = host
+	parsedUrl.User = nil
+
+	parsedUrl.Fragment = ""
+	parsedUrl.RawFragment = ""
+	if parsedUrl.Path == "" {
+		parsedUrl.Path = "/"
+		parsedUrl.RawPath = ""
+	}
 
-			// ADDED: if the new url is different from the initial host url, ignore it
-			// to prevent crawling beyond the initial host and return an error
-			if parsedUrl.Host != hostUrl.Host {
-				return "error"
+	if stripTracking && parsedUrl.RawQuery != "" {
+		// The other parameters keep their order and encoding, as a server may
+		// tell them apart.
+		var kept []string
+		for _, param := range strings.Split(parsedUrl.RawQuery, "&") {
+			key, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(key); err == nil {
+				key = unescaped
+			}
+			key = strings.ToLower(key)
+			if _, tracking := trackingParams[key]; !tracking && !strings.HasPrefix(key, "utm_") {
+				kept = append(kept, param)
 			}
-
-			return parsedUrl.String()
 		}
+		parsedUrl.RawQuery = strings.Join(kept, "&")
 	}
+	parsedUrl.ForceQuery = false
 
-	if err != nil {
-		log.Fatalf("Url could not be parsed %v", err)
+	return parsedUrl.String(), nil
+}
+
+// Reports whether the url may point to a page, judging by its extension.
+func isPageURL(rawUrl string) bool {
+	if parsedUrl, err := url.Parse(rawUrl); err == nil {
+		_, skipped := skippedExtensions[strings.ToLower(path.Ext(parsedUrl.Path))]
+		return !skipped
 	}
-	return ""
+	return false
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Fetcher downloads pages with a fixed pool of workers. It limits how many
+// requests run at once in total and against each host, and spaces out the
+// requests to a host by that host's crawl delay.
+type Fetcher struct {
+	workers   int
+	hostLimit int
+	timeout   time.Duration
+	userAgent string
+	global    chan struct{}
+	client    *http.Client
+	robots    *robotsCache
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+// The politeness state of a single host.
+type hostState struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	next  time.Time
+}
+
+func newFetcher(config Config, robots *robotsCache) *Fetcher {
+	workers, hostLimit, globalLimit := config.workers, config.hostLimit, config.globalLimit
+	if workers < 1 {
+		workers = 1
+	}
+	if hostLimit < 1 {
+		hostLimit = 1
+	}
+	if globalLimit < 1 {
+		globalLimit = workers
+	}
+	f := &Fetcher{
+		workers:   workers,
+		hostLimit: hostLimit,
+		timeout:   config.timeout,
+		userAgent: config.userAgent,
+		global:    make(chan struct{}, globalLimit),
+		robots:    robots,
+		hosts:     make(map[string]*hostState),
+	}
+	f.client = &http.Client{CheckRedirect: f.checkRedirect}
+	return f
+}
+
+// Returned for urls that robots.txt does not allow us to crawl.
+var errRobotsDisallowed = errors.New("disallowed by robots.txt")
+
+// Redirects are followed only to urls that robots.txt allows as well.
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	return f.robots.check(req.URL)
+}
+
+// Start the workers. They download every url received on in and send the
+// results on out. out is closed once in is closed and the workers are done.
+func (f *Fetcher) start(in <-chan frontierItem, out chan<- DownloadResult) {
+	var wg sync.WaitGroup
+	wg.Add(f.workers)
+	for i := 0; i < f.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				out <- f.fetch(item)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// Returns the politeness state of the host, creating it on first use.
+func (f *Fetcher) host(name string) *hostState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	host, exists := f.hosts[name]
+	if !exists {
+		host = &hostState{slots: make(chan struct{}, f.hostLimit)}
+		f.hosts[name] = host
+	}
+	return host
+}
+
+// Block until the host's crawl delay since the previous request has passed.
+func (host *hostState) wait(delay time.Duration) {
+	host.mu.Lock()
+	now := time.Now()
+	start := host.next
+	if start.Before(now) {
+		start = now
+	}
+	host.next = start.Add(delay)
+	host.mu.Unlock()
+
+	time.Sleep(start.Sub(now))
+}
+
+// Download a page for the crawl, skipping bodies no parser could handle.
+func (f *Fetcher) fetch(item frontierItem) DownloadResult {
+	return f.fetchPolitely(item, acceptContentType)
+}
+
+// Download the url once robots.txt allows it, a slot for its host is free and
+// the host's crawl delay has passed. accept is passed on to download.
+func (f *Fetcher) fetchPolitely(item frontierItem, accept func(contentType string) error) DownloadResult {
+	result := DownloadResult{item: item}
+	parsedUrl, err := url.Parse(item.url)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	// Every url is checked against the robots.txt of its own host before
+	// it can take up a slot.
+	if err := f.robots.check(parsedUrl); err != nil {
+		result.err = err
+		return result
+	}
+
+	// Take a slot for the host first so that waiting out its crawl delay
+	// does not hold up requests to other hosts.
+	host := f.host(parsedUrl.Host)
+	host.slots <- struct{}{}
+	defer func() { <-host.slots }()
+	host.wait(f.robots.crawlDelay(parsedUrl))
+
+	f.global <- struct{}{}
+	defer func() { <-f.global }()
+
+	result.body, result.contentType, result.err = f.download(item.url, accept)
+	return result
+}
+
+// Download the url without waiting for its host. When accept is given, the
+// body is only read if accept returns no error for the response's
+// Content-Type. The timeout covers both the request and reading the body.
+func (f *Fetcher) download(rawUrl string, accept func(contentType string) error) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+
+	// get the contents of a given URL and return a slice of bytes
+	rsp, err := f.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return nil, "", statusError{code: rsp.StatusCode}
+	}
+	contentType := rsp.Header.Get("Content-Type")
+	if accept != nil {
+		if err := accept(contentType); err != nil {
+			return nil, contentType, err
+		}
+	}
+	body, err := io.ReadAll(rsp.Body)
+	return body, contentType, err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Field is the part of a page a term occurs in. Terms in the title,
+// headings and description count as text of the page as well, and inbound
+// anchors are the text of links to the page on other pages.
+type Field int
+
+const (
+	bodyField Field = iota
+	titleField
+	headingField
+	descriptionField
+	anchorField
+	fieldCount
+)
+
+var fieldNames = [fieldCount]string{"body", "title", "heading", "description", "anchor"}
+
+func (field Field) String() string {
+	if field < 0 || field >= fieldCount {
+		return "field(" + strconv.Itoa(int(field)) + ")"
+	}
+	return fieldNames[field]
+}
+
+// How much an occurrence of a term in each field counts towards its score.
+type FieldWeights [fieldCount]float64
+
+const defaultFieldWeights = "body=1,title=3,heading=2,description=1.5,anchor=2"
+
+// Parse weights written as field=weight pairs separated by commas, such as
+// "title=3,heading=2". Fields that are not given weigh 1.
+func parseFieldWeights(text string) (FieldWeights, error) {
+	var weights FieldWeights
+	for i := range weights {
+		weights[i] = 1
+	}
+	for _, pair := range strings.Split(text, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		if !found {
+			return weights, fmt.Errorf("field weight %q is not written as field=weight", pair)
+		}
+		field := fieldByName(strings.TrimSpace(name))
+		if field < 0 {
+			return weights, fmt.Errorf("unknown field %q, choose one of %s", name, strings.Join(fieldNames[:], ", "))
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || weight < 0 {
+			return weights, fmt.Errorf("weight of %s must be a number of at least 0, not %q", name, value)
+		}
+		weights[field] = weight
+	}
+	return weights, nil
+}
+
+// Returns the field with the name, or -1 when there is none.
+func fieldByName(name string) Field {
+	for field, fieldName := range fieldNames {
+		if fieldName == name {
+			return Field(field)
+		}
+	}
+	return -1
+}
+
+// Returns the occurrences at the positions, each counted by the weight of
+// its field.
+func (weights FieldWeights) weigh(positions []Position) float64 {
+	total := 0.0
+	for _, position := range positions {
+		total += weights[position.field]
+	}
+	return total
+}
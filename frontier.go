@@ -0,0 +1,91 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// The priority of pages that do not have one, as in the sitemap protocol.
+const defaultPriority = 0.5
+
+type frontierItem struct {
+	url      string
+	depth    int
+	priority float64
+	// The order the item was queued in, so that equal items come out first
+	// in, first out.
+	order int
+}
+
+// frontierQueue orders items by priority, then by depth.
+type frontierQueue []frontierItem
+
+func (q frontierQueue) Len() int      { return len(q) }
+func (q frontierQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q frontierQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	if q[i].depth != q[j].depth {
+		return q[i].depth < q[j].depth
+	}
+	return q[i].order < q[j].order
+}
+func (q *frontierQueue) Push(x any) { *q = append(*q, x.(frontierItem)) }
+func (q *frontierQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Frontier is the queue of urls waiting to be crawled. It remembers every url
+// it has accepted so that each page is only crawled once per run.
+type Frontier struct {
+	mu       sync.Mutex
+	queue    frontierQueue
+	seen     map[string]struct{}
+	maxDepth int
+	maxPages int
+}
+
+// A negative maxDepth or a maxPages of 0 means no limit.
+func newFrontier(maxDepth, maxPages int) *Frontier {
+	return &Frontier{
+		seen:     make(map[string]struct{}),
+		maxDepth: maxDepth,
+		maxPages: maxPages,
+	}
+}
+
+// Queue the url unless it was already seen, is too deep or the page budget
+// has been used up. Returns whether the url was accepted.
+func (f *Frontier) push(url string, depth int, priority float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.seen[url]; exists {
+		return false
+	}
+	if f.maxDepth >= 0 && depth > f.maxDepth {
+		return false
+	}
+	if f.maxPages > 0 && len(f.seen) >= f.maxPages {
+		return false
+	}
+	f.seen[url] = struct{}{}
+	heap.Push(&f.queue, frontierItem{url: url, depth: depth, priority: priority, order: len(f.seen)})
+	return true
+}
+
+// Take the most important url off the queue. Returns false when the queue is
+// empty.
+func (f *Frontier) pop() (frontierItem, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.queue) == 0 {
+		return frontierItem{}, false
+	}
+	return heap.Pop(&f.queue).(frontierItem), true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Compute the PageRank of every url in the links. Each url passes damping of
+// its rank on to the urls it links to, split evenly, and urls without links
+// spread theirs over every url. Iterates until the ranks change by less than
+// tolerance in total, or for at most maxIterations. The ranks are scaled so
+// that the average url has 1. Returns the ranks by url id and the amount of
+// iterations run.
+func pageRank(links []Link, damping float64, maxIterations int, tolerance float64) (map[int]float64, int) {
+	// Several links between the same urls count as one.
+	outLinks := make(map[int]map[int]struct{})
+	nodes := make(map[int]struct{})
+	for _, link := range links {
+		nodes[link.fromID] = struct{}{}
+		nodes[link.toID] = struct{}{}
+		if outLinks[link.fromID] == nil {
+			outLinks[link.fromID] = make(map[int]struct{})
+		}
+		outLinks[link.fromID][link.toID] = struct{}{}
+	}
+	n := float64(len(nodes))
+	if n == 0 {
+		return map[int]float64{}, 0
+	}
+
+	ranks := make(map[int]float64, len(nodes))
+	for node := range nodes {
+		ranks[node] = 1 / n
+	}
+	iterations := 0
+	for iterations < maxIterations {
+		iterations++
+		dangling := 0.0
+		for node := range nodes {
+			if len(outLinks[node]) == 0 {
+				dangling += ranks[node]
+			}
+		}
+		next := make(map[int]float64, len(nodes))
+		for node := range nodes {
+			next[node] = (1-damping)/n + damping*dangling/n
+		}
+		for from, targets := range outLinks {
+			share := damping * ranks[from] / float64(len(targets))
+			for to := range targets {
+				next[to] += share
+			}
+		}
+
+		change := 0.0
+		for node := range nodes {
+			change += math.Abs(next[node] - ranks[node])
+		}
+		ranks = next
+		if change < tolerance {
+			break
+		}
+	}
+
+	for node := range ranks {
+		ranks[node] *= n
+	}
+	return ranks, iterations
+}
+
+// Compute the authority of every url from the links in the store, and store
+// it. Returns the authority by url id and the amount of iterations run.
+func (ebook *Index) computeAuthority(damping float64, maxIterations int, tolerance float64) (map[int]float64, int, error) {
+	links, err := ebook.store.links()
+	if err != nil {
+		return nil, 0, err
+	}
+	authority, iterations := pageRank(links, damping, maxIterations, tolerance)
+	if err := ebook.store.setAuthority(authority); err != nil {
+		return nil, 0, err
+	}
+	return authority, iterations, nil
+}
+
+// Scale the text score of a result by the authority of its url. weight is
+// how much the authority counts, from 0 for not at all to 1 for fully.
+func blendAuthority(score, authority, weight float64) float64 {
+	return score * ((1 - weight) + weight*authority)
+}
+
+// The formats the link graph can be written in.
+var linkFormats = []string{"csv", "json", "dot"}
+
+// Write the links in the format: CSV with a header row, a JSON array, or a
+// Graphviz digraph labelled with the text of each link.
+func writeLinks(w io.Writer, links []Link, format string) error {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"from", "to", "anchor_text"})
+		for _, link := range links {
+			writer.Write([]string{link.from, link.to, link.anchorText})
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case "json":
+		type jsonLink struct {
+			From       string `json:"from"`
+			To         string `json:"to"`
+			AnchorText string `json:"anchor_text"`
+		}
+		jsonLinks := make([]jsonLink, 0, len(links))
+		for _, link := range links {
+			jsonLinks = append(jsonLinks, jsonLink{From: link.from, To: link.to, AnchorText: link.anchorText})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(jsonLinks)
+
+	case "dot":
+		if _, err := fmt.Fprintln(w, "digraph links {"); err != nil {
+			return err
+		}
+		for _, link := range links {
+			_, err := fmt.Fprintf(w, "  %s -> %s [label=%s];\n", strconv.Quote(link.from), strconv.Quote(link.to), strconv.Quote(link.anchorText))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintln(w, "}")
+		return err
+	}
+	return fmt.Errorf("unknown link format %q", format)
+}
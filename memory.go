@@ -0,0 +1,537 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Store kept in memory, for tests and crawls too small to need a database.
+// Ids start at 1 like the SQLite ids do.
+type memoryStore struct {
+	mu sync.Mutex
+
+	urls      []memoryURL
+	urlIDs    map[string]int
+	terms     []string
+	termIDs   map[string]int
+	sentences []memorySentence
+	// The ids of the sentences of each url, in the order they were added.
+	urlSentences map[int][]int
+	// The postings of each term and bigram, by url id.
+	termIndex   map[int]map[int]*Posting
+	bigramIndex map[[2]int]map[int]*Posting
+	// The positions of each term, by url id.
+	positionIndex map[int]map[int][]Position
+	// The occurrences of each term in the text of links, by the url linked
+	// to and then the url the link is on.
+	anchorIndex map[int]map[int]map[int]int
+	// The links from each url.
+	linkIndex map[int][]memoryLink
+	authority map[int]float64
+	// The amount of terms of each url that has any, and of all of them.
+	urlTerms    map[int]int
+	corpusTerms int
+	// The occurrences of each word as written, by url id, and the id of
+	// the term each word is stemmed to.
+	surfaceIndex map[string]map[int]int
+	surfaceTerms map[string]int
+	skipped      map[string]memorySkipped
+	schedule     map[string]memorySchedule
+}
+
+type memoryURL struct {
+	name, title string
+	// The indexVersion the url was indexed at, or 0 when it was not.
+	indexVersion int
+}
+
+type memorySentence struct {
+	urlID    int
+	sentence string
+}
+
+type memoryLink struct {
+	toID       int
+	anchorText string
+}
+
+type memorySkipped struct {
+	reason, detail string
+}
+
+type memorySchedule struct {
+	lastmod, changefreq string
+	priority            float64
+	crawledAt           string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		urlIDs:        make(map[string]int),
+		termIDs:       make(map[string]int),
+		urlSentences:  make(map[int][]int),
+		termIndex:     make(map[int]map[int]*Posting),
+		bigramIndex:   make(map[[2]int]map[int]*Posting),
+		positionIndex: make(map[int]map[int][]Position),
+		anchorIndex:   make(map[int]map[int]map[int]int),
+		linkIndex:     make(map[int][]memoryLink),
+		authority:     make(map[int]float64),
+		urlTerms:      make(map[int]int),
+		surfaceIndex:  make(map[string]map[int]int),
+		surfaceTerms:  make(map[string]int),
+		skipped:       make(map[string]memorySkipped),
+		schedule:      make(map[string]memorySchedule),
+	}
+}
+
+func (store *memoryStore) upsertURL(url string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.addURL(url), nil
+}
+
+func (store *memoryStore) upsertTerm(term string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.addTerm(term), nil
+}
+
+// Returns the id of the url, adding it when it is new. The caller holds mu.
+func (store *memoryStore) addURL(url string) int {
+	if id, exists := store.urlIDs[url]; exists {
+		return id
+	}
+	store.urls = append(store.urls, memoryURL{name: url})
+	store.urlIDs[url] = len(store.urls)
+	return len(store.urls)
+}
+
+// Returns the id of the term, adding it when it is new. The caller holds mu.
+func (store *memoryStore) addTerm(term string) int {
+	if id, exists := store.termIDs[term]; exists {
+		return id
+	}
+	store.terms = append(store.terms, term)
+	store.termIDs[term] = len(store.terms)
+	return len(store.terms)
+}
+
+func (store *memoryStore) findURL(url string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	id, exists := store.urlIDs[url]
+	if !exists {
+		return 0, storageError("could not find url "+url, ErrNotFound)
+	}
+	return id, nil
+}
+
+func (store *memoryStore) findTerm(term string) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	id, exists := store.termIDs[term]
+	if !exists {
+		return 0, storageError("could not find word "+term, ErrNotFound)
+	}
+	return id, nil
+}
+
+func (store *memoryStore) isIndexed(urlID int) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return urlID > 0 && urlID <= len(store.urls) && store.urls[urlID-1].indexVersion >= indexVersion, nil
+}
+
+// The old sentences of the url stay in the slice so that the ids of the
+// others do not change, but they can no longer be found through the url.
+func (store *memoryStore) writePage(page *PageIndex) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	urlID := store.addURL(page.url)
+	for _, postings := range store.termIndex {
+		delete(postings, urlID)
+	}
+	for _, postings := range store.bigramIndex {
+		delete(postings, urlID)
+	}
+	for _, positions := range store.positionIndex {
+		delete(positions, urlID)
+	}
+	for _, targets := range store.anchorIndex {
+		for _, sources := range targets {
+			delete(sources, urlID)
+		}
+	}
+	for _, urls := range store.surfaceIndex {
+		delete(urls, urlID)
+	}
+	store.corpusTerms -= store.urlTerms[urlID]
+	delete(store.urlTerms, urlID)
+	if terms := page.totalTerms(); terms > 0 {
+		store.urlTerms[urlID] = terms
+		store.corpusTerms += terms
+	}
+
+	sentenceIDs := make([]int, len(page.sentences))
+	store.urlSentences[urlID] = nil
+	for i, sentence := range page.sentences {
+		store.sentences = append(store.sentences, memorySentence{urlID: urlID, sentence: sentence})
+		sentenceIDs[i] = len(store.sentences)
+		store.urlSentences[urlID] = append(store.urlSentences[urlID], sentenceIDs[i])
+	}
+
+	for term, count := range page.terms {
+		termID := store.addTerm(term)
+		if store.termIndex[termID] == nil {
+			store.termIndex[termID] = make(map[int]*Posting)
+		}
+		store.termIndex[termID][urlID] = &Posting{urlID: urlID, occurrences: count.occurrences, sentenceID: sentenceIDs[count.sentence]}
+
+		if store.positionIndex[termID] == nil {
+			store.positionIndex[termID] = make(map[int][]Position)
+		}
+		positions := make([]Position, len(count.positions))
+		for i, position := range count.positions {
+			positions[i] = Position{offset: position.offset, sentence: sentenceIDs[position.sentence], field: position.field}
+		}
+		store.positionIndex[termID][urlID] = positions
+	}
+	for bigram, count := range page.bigrams {
+		key := [2]int{store.addTerm(bigram[0]), store.addTerm(bigram[1])}
+		if store.bigramIndex[key] == nil {
+			store.bigramIndex[key] = make(map[int]*Posting)
+		}
+		store.bigramIndex[key][urlID] = &Posting{urlID: urlID, occurrences: count.occurrences, sentenceID: sentenceIDs[count.sentence]}
+	}
+
+	for target, anchorTerms := range page.anchorTerms {
+		targetID := store.addURL(target)
+		for term, occurrences := range anchorTerms {
+			termID := store.addTerm(term)
+			if store.anchorIndex[termID] == nil {
+				store.anchorIndex[termID] = make(map[int]map[int]int)
+			}
+			if store.anchorIndex[termID][targetID] == nil {
+				store.anchorIndex[termID][targetID] = make(map[int]int)
+			}
+			store.anchorIndex[termID][targetID][urlID] = occurrences
+		}
+	}
+
+	for term, forms := range page.surfaceForms {
+		termID := store.addTerm(term)
+		for form, occurrences := range forms {
+			if store.surfaceIndex[form] == nil {
+				store.surfaceIndex[form] = make(map[int]int)
+			}
+			store.surfaceIndex[form][urlID] = occurrences
+			store.surfaceTerms[form] = termID
+		}
+	}
+
+	store.linkIndex[urlID] = nil
+	for link := range page.links {
+		store.linkIndex[urlID] = append(store.linkIndex[urlID], memoryLink{toID: store.addURL(link[0]), anchorText: link[1]})
+	}
+
+	store.urls[urlID-1].title = page.title
+	store.urls[urlID-1].indexVersion = indexVersion
+	entry := store.schedule[page.url]
+	entry.crawledAt = time.Now().UTC().Format(time.RFC3339)
+	store.schedule[page.url] = entry
+	return nil
+}
+
+func (store *memoryStore) postings(termID int) ([]Posting, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return sortedPostings(store.termIndex[termID]), nil
+}
+
+func (store *memoryStore) bigramPostings(term1ID, term2ID int) ([]Posting, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return sortedPostings(store.bigramIndex[[2]int{term1ID, term2ID}]), nil
+}
+
+// Orders the forms by the amount of urls they occur in, most first, like
+// the database orders them.
+func sortSurfaceForms(forms []SurfaceForm) {
+	sort.Slice(forms, func(i, j int) bool {
+		if forms[i].documents == forms[j].documents {
+			return forms[i].form < forms[j].form
+		}
+		return forms[i].documents > forms[j].documents
+	})
+}
+
+// Returns copies of the postings ordered by url id, like the database
+// returns them.
+func sortedPostings(postings map[int]*Posting) []Posting {
+	var sorted []Posting
+	for _, posting := range postings {
+		sorted = append(sorted, *posting)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].urlID < sorted[j].urlID })
+	return sorted
+}
+
+func (store *memoryStore) positions(termID int) (map[int][]Position, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	positions := make(map[int][]Position, len(store.positionIndex[termID]))
+	for urlID, urlPositions := range store.positionIndex[termID] {
+		positions[urlID] = append([]Position(nil), urlPositions...)
+	}
+	return positions, nil
+}
+
+func (store *memoryStore) anchorCounts(termID int) (map[int]int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	counts := make(map[int]int)
+	for targetID, sources := range store.anchorIndex[termID] {
+		for _, occurrences := range sources {
+			counts[targetID] += occurrences
+		}
+	}
+	return counts, nil
+}
+
+// Returns the links ordered like the database orders them.
+func (store *memoryStore) links() ([]Link, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var links []Link
+	for fromID, urlLinks := range store.linkIndex {
+		for _, link := range urlLinks {
+			links = append(links, Link{
+				fromID:     fromID,
+				toID:       link.toID,
+				from:       store.urls[fromID-1].name,
+				to:         store.urls[link.toID-1].name,
+				anchorText: link.anchorText,
+			})
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].fromID != links[j].fromID {
+			return links[i].fromID < links[j].fromID
+		}
+		if links[i].toID != links[j].toID {
+			return links[i].toID < links[j].toID
+		}
+		return links[i].anchorText < links[j].anchorText
+	})
+	return links, nil
+}
+
+func (store *memoryStore) setAuthority(authority map[int]float64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.authority = make(map[int]float64, len(authority))
+	for urlID, score := range authority {
+		store.authority[urlID] = score
+	}
+	return nil
+}
+
+func (store *memoryStore) docStats(urlIDs []int) (map[int]DocStats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stats := make(map[int]DocStats, len(urlIDs))
+	for _, urlID := range urlIDs {
+		if urlID < 1 || urlID > len(store.urls) {
+			return nil, storageError("could not find url", ErrNotFound)
+		}
+		urlStats := DocStats{url: store.urls[urlID-1].name, title: store.urls[urlID-1].title, authority: 1, totalTerms: store.urlTerms[urlID]}
+		if authority, exists := store.authority[urlID]; exists {
+			urlStats.authority = authority
+		}
+		stats[urlID] = urlStats
+	}
+	return stats, nil
+}
+
+func (store *memoryStore) documentCount() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Only urls with at least one term count, so that urls linked to but
+	// not crawled and pages of only stopwords are left out, as they are by
+	// the SQLite store.
+	return len(store.urlTerms), nil
+}
+
+func (store *memoryStore) totalTerms() (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.corpusTerms, nil
+}
+
+func (store *memoryStore) vocabulary() (map[string]int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	vocabulary := make(map[string]int)
+	for termID, postings := range store.termIndex {
+		if len(postings) > 0 {
+			vocabulary[store.terms[termID-1]] = len(postings)
+		}
+	}
+	return vocabulary, nil
+}
+
+func (store *memoryStore) bigramVocabulary() (map[[2]string]int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	vocabulary := make(map[[2]string]int)
+	for termIDs, postings := range store.bigramIndex {
+		if len(postings) > 0 {
+			vocabulary[[2]string{store.terms[termIDs[0]-1], store.terms[termIDs[1]-1]}] = len(postings)
+		}
+	}
+	return vocabulary, nil
+}
+
+func (store *memoryStore) matchSurfaceForms(pattern string, limit int) ([]SurfaceForm, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var forms []SurfaceForm
+	for form, urls := range store.surfaceIndex {
+		if len(urls) > 0 && matchWildcard(pattern, form) {
+			forms = append(forms, SurfaceForm{form: form, term: store.terms[store.surfaceTerms[form]-1], documents: len(urls)})
+		}
+	}
+	sortSurfaceForms(forms)
+	return forms[:min(limit, len(forms))], nil
+}
+
+func (store *memoryStore) commonSurfaceForms() (map[string]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var forms []SurfaceForm
+	for form, urls := range store.surfaceIndex {
+		if len(urls) > 0 {
+			forms = append(forms, SurfaceForm{form: form, term: store.terms[store.surfaceTerms[form]-1], documents: len(urls)})
+		}
+	}
+	return mostCommonForms(forms), nil
+}
+
+func (store *memoryStore) snippet(urlID, sentenceID, minLength int) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var sentences []string
+	length := 0
+	for _, id := range store.urlSentences[urlID] {
+		if id < sentenceID {
+			continue
+		}
+		if length >= minLength {
+			break
+		}
+		sentence := store.sentences[id-1].sentence
+		sentences = append(sentences, sentence)
+		length += len(sentence) + 1
+	}
+	if len(sentences) == 0 {
+		return "", storageError("could not find sentence", ErrNotFound)
+	}
+	return strings.Join(sentences, " "), nil
+}
+
+func (store *memoryStore) addSkipped(url, reason, detail string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.skipped[url] = memorySkipped{reason: reason, detail: detail}
+	return nil
+}
+
+func (store *memoryStore) addSchedule(url, lastmod, changefreq string, priority float64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry := store.schedule[url]
+	entry.lastmod, entry.changefreq, entry.priority = lastmod, changefreq, priority
+	store.schedule[url] = entry
+	return nil
+}
+
+func (store *memoryStore) getSchedule(url string) (lastmod, changefreq, crawledAt string, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entry := store.schedule[url]
+	return entry.lastmod, entry.changefreq, entry.crawledAt, nil
+}
+
+// Returns the amount of rows each table of the SQLite store would have.
+func (store *memoryStore) stats() ([]StoreStat, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sentences := 0
+	for _, ids := range store.urlSentences {
+		sentences += len(ids)
+	}
+	frequency, bigrams, positions, anchorTerms := 0, 0, 0, 0
+	for _, postings := range store.termIndex {
+		frequency += len(postings)
+	}
+	for _, urlPositions := range store.positionIndex {
+		for _, termPositions := range urlPositions {
+			positions += len(termPositions)
+		}
+	}
+	for _, postings := range store.bigramIndex {
+		bigrams += len(postings)
+	}
+	for _, targets := range store.anchorIndex {
+		for _, sources := range targets {
+			anchorTerms += len(sources)
+		}
+	}
+	links := 0
+	for _, urlLinks := range store.linkIndex {
+		links += len(urlLinks)
+	}
+	return []StoreStat{
+		{name: "urls", count: len(store.urls)},
+		{name: "words", count: len(store.terms)},
+		{name: "sentences", count: sentences},
+		{name: "frequency", count: frequency},
+		{name: "bigrams", count: bigrams},
+		{name: "positions", count: positions},
+		{name: "anchor_terms", count: anchorTerms},
+		{name: "links", count: links},
+		{name: "authority", count: len(store.authority)},
+		{name: "skipped_urls", count: len(store.skipped)},
+		{name: "url_schedule", count: len(store.schedule)},
+	}, nil
+}
+
+func (store *memoryStore) close() error {
+	return nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The migrations that bring a database up to the current schema, in order.
+// Migration i upgrades a database from schema version i to version i+1.
+// Released migrations must not be changed, since databases that already ran
+// them would not pick the change up. Change the schema by adding a new one.
+var migrations = []func(tx *sql.Tx) error{
+	createTables,
+	addUniqueKeys,
+	addLookupIndexes,
+	addPositions,
+	addFields,
+	addLinks,
+	addSurfaceForms,
+	addURLStats,
+}
+
+// Upgrade the database to the latest schema version. Each migration runs in
+// its own transaction along with the update of schema_version, so a failed
+// migration leaves the database at the version before it. Databases created
+// before schema_version existed are at version 0.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)")
+	if err != nil {
+		return storageError("could not create schema_version table", err)
+	}
+	var version int
+	err = db.QueryRow("SELECT IFNULL(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return storageError("could not read schema version", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than %d: %w", version, len(migrations), ErrStorage)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return storageError("could not begin migration", err)
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration to schema version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version+1); err != nil {
+			tx.Rollback()
+			return storageError("could not update schema version", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return storageError("could not commit migration", err)
+		}
+		fmt.Println("Migrated database to schema version", version+1)
+	}
+	return nil
+}
+
+// Run each statement, stopping at the first that fails.
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return storageError("could not run "+statement, err)
+		}
+	}
+	return nil
+}
+
+// Version 1: the tables as the crawler first created them. Databases from
+// before schema_version already have some or all of them.
+func createTables(tx *sql.Tx) error {
+	// Create the table if it doesn't already exist.
+	_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS urls (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT,
+			title TEXT
+		)
+	`)
+	if err != nil {
+		return storageError("could not create urls table", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS words (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT
+		)
+	`)
+	if err != nil {
+		return storageError("could not create words table", err)
+	}
+
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS sentences (
+			id INTEGER NOT NULL PRIMARY KEY,
+			sentence TEXT,
+			url_id INTEGER,
+			UNIQUE(sentence, url_id),
+			FOREIGN KEY (url_id) REFERENCES urls(id)
+		)
+	`)
+	if err != nil {
+		return storageError("could not create sentences table", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS frequency (
+			id INTEGER NOT NULL PRIMARY KEY,
+			url_id INTEGER,
+			word_id INTEGER,
+			sentence_id INTEGER,
+			occurrences INTEGER,
+			FOREIGN KEY (url_id) REFERENCES urls(id),
+			FOREIGN KEY (word_id) REFERENCES words(id),
+			FOREIGN KEY (sentence_id) REFERENCES sentences(id)
+		)
+	`)
+	if err != nil {
+		return storageError("could not create frequency table", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS bigrams (
+			id INTEGER NOT NULL PRIMARY KEY,
+			url_id INTEGER,
+			word1_id INTEGER,
+			word2_id INTEGER,
+			sentence_id INTEGER,
+			occurrences INTEGER,
+			FOREIGN KEY (url_id) REFERENCES urls(id),
+			FOREIGN KEY (word1_id) REFERENCES words(id),
+			FOREIGN KEY (word2_id) REFERENCES words(id),
+			FOREIGN KEY (sentence_id) REFERENCES sentences(id)
+		)
+	`)
+	if err != nil {
+		return storageError("could not create bigrams table", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS skipped_urls (
+			id INTEGER NOT NULL PRIMARY KEY,
+			name TEXT UNIQUE,
+			reason TEXT,
+			detail TEXT
+		)
+	`)
+	if err != nil {
+		return storageError("could not create skipped_urls table", err)
+	}
+
+	// Sitemap metadata and the last time each page was indexed, used to
+	// order the crawl and to decide when to crawl a page again.
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS url_schedule (
+			name TEXT NOT NULL PRIMARY KEY,
+			lastmod TEXT,
+			changefreq TEXT,
+			priority REAL,
+			crawled_at TEXT
+		)
+	`)
+	if err != nil {
+		return storageError("could not create url_schedule table", err)
+	}
+
+	return nil
+}
+
+// Version 2: unique keys on the names of words and urls and on the postings
+// of each url. Older databases could get duplicate rows under concurrency, so
+// those are merged first. Postings of duplicate words are moved to the first
+// row of the word, postings of duplicate urls are dropped since pages were
+// always indexed under the first row of their url, and duplicate postings
+// are summed up.
+func addUniqueKeys(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TEMP TABLE duplicate_words AS
+			SELECT words.id AS id, firsts.id AS first_id FROM words
+			JOIN (SELECT name, MIN(id) AS id FROM words GROUP BY name HAVING COUNT(*) > 1) AS firsts
+			ON firsts.name = words.name AND firsts.id <> words.id`,
+		`UPDATE frequency SET word_id = (SELECT first_id FROM duplicate_words WHERE id = word_id)
+			WHERE word_id IN (SELECT id FROM duplicate_words)`,
+		`UPDATE bigrams SET word1_id = (SELECT first_id FROM duplicate_words WHERE id = word1_id)
+			WHERE word1_id IN (SELECT id FROM duplicate_words)`,
+		`UPDATE bigrams SET word2_id = (SELECT first_id FROM duplicate_words WHERE id = word2_id)
+			WHERE word2_id IN (SELECT id FROM duplicate_words)`,
+		"DELETE FROM words WHERE id IN (SELECT id FROM duplicate_words)",
+		"DROP TABLE duplicate_words",
+
+		`CREATE TEMP TABLE duplicate_urls AS
+			SELECT id FROM urls WHERE id NOT IN (SELECT MIN(id) FROM urls GROUP BY name)`,
+		"DELETE FROM frequency WHERE url_id IN (SELECT id FROM duplicate_urls)",
+		"DELETE FROM bigrams WHERE url_id IN (SELECT id FROM duplicate_urls)",
+		"DELETE FROM sentences WHERE url_id IN (SELECT id FROM duplicate_urls)",
+		"DELETE FROM urls WHERE id IN (SELECT id FROM duplicate_urls)",
+		"DROP TABLE duplicate_urls",
+
+		`CREATE TEMP TABLE frequency_totals AS
+			SELECT MIN(id) AS id, SUM(occurrences) AS occurrences FROM frequency
+			GROUP BY url_id, word_id HAVING COUNT(*) > 1`,
+		`UPDATE frequency SET occurrences = (SELECT occurrences FROM frequency_totals WHERE frequency_totals.id = frequency.id)
+			WHERE id IN (SELECT id FROM frequency_totals)`,
+		"DELETE FROM frequency WHERE id NOT IN (SELECT MIN(id) FROM frequency GROUP BY url_id, word_id)",
+		"DROP TABLE frequency_totals",
+
+		`CREATE TEMP TABLE bigram_totals AS
+			SELECT MIN(id) AS id, SUM(occurrences) AS occurrences FROM bigrams
+			GROUP BY url_id, word1_id, word2_id HAVING COUNT(*) > 1`,
+		`UPDATE bigrams SET occurrences = (SELECT occurrences FROM bigram_totals WHERE bigram_totals.id = bigrams.id)
+			WHERE id IN (SELECT id FROM bigram_totals)`,
+		"DELETE FROM bigrams WHERE id NOT IN (SELECT MIN(id) FROM bigrams GROUP BY url_id, word1_id, word2_id)",
+		"DROP TABLE bigram_totals",
+
+		"CREATE UNIQUE INDEX words_name ON words (name)",
+		"CREATE UNIQUE INDEX urls_name ON urls (name)",
+		"CREATE UNIQUE INDEX frequency_url_word ON frequency (url_id, word_id)",
+		"CREATE UNIQUE INDEX bigrams_url_words ON bigrams (url_id, word1_id, word2_id)",
+	)
+}
+
+// Version 3: covering indexes for reading the postings of a term or bigram,
+// and an index for reading the sentences of a url in order.
+func addLookupIndexes(tx *sql.Tx) error {
+	return execAll(tx,
+		"CREATE INDEX frequency_postings ON frequency (word_id, url_id, occurrences, sentence_id)",
+		"CREATE INDEX bigrams_postings ON bigrams (word1_id, word2_id, url_id, occurrences, sentence_id)",
+		"CREATE INDEX sentences_url ON sentences (url_id, id)",
+	)
+}
+
+// Version 4: the position of every occurrence of a term. Pages indexed
+// before this version have no positions, so they are indexed again the next
+// time they are crawled.
+func addPositions(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE positions (
+			word_id INTEGER NOT NULL,
+			url_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			sentence_id INTEGER NOT NULL,
+			PRIMARY KEY (word_id, url_id, position),
+			FOREIGN KEY (url_id) REFERENCES urls(id),
+			FOREIGN KEY (word_id) REFERENCES words(id),
+			FOREIGN KEY (sentence_id) REFERENCES sentences(id)
+		) WITHOUT ROWID`,
+		"CREATE INDEX positions_url ON positions (url_id)",
+	)
+}
+
+// Version 5: the field of each position, and the terms of the text of links
+// to each url along with the url they are on. Positions from before this
+// version are body text until their page is indexed again.
+func addFields(tx *sql.Tx) error {
+	return execAll(tx,
+		"ALTER TABLE positions ADD COLUMN field INTEGER NOT NULL DEFAULT 0",
+		`CREATE TABLE anchor_terms (
+			word_id INTEGER NOT NULL,
+			url_id INTEGER NOT NULL,
+			from_url_id INTEGER NOT NULL,
+			occurrences INTEGER NOT NULL,
+			PRIMARY KEY (word_id, url_id, from_url_id),
+			FOREIGN KEY (word_id) REFERENCES words(id),
+			FOREIGN KEY (url_id) REFERENCES urls(id),
+			FOREIGN KEY (from_url_id) REFERENCES urls(id)
+		) WITHOUT ROWID`,
+		"CREATE INDEX anchor_terms_from ON anchor_terms (from_url_id)",
+	)
+}
+
+// Version 6: the links between urls, with the text of each link, and the
+// authority of each url computed from them. Every url also records the
+// indexVersion it was indexed at, so that urls indexed before links were
+// stored are indexed again when they are crawled.
+func addLinks(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE links (
+			from_url_id INTEGER NOT NULL,
+			to_url_id INTEGER NOT NULL,
+			anchor_text TEXT NOT NULL,
+			PRIMARY KEY (from_url_id, to_url_id, anchor_text),
+			FOREIGN KEY (from_url_id) REFERENCES urls(id),
+			FOREIGN KEY (to_url_id) REFERENCES urls(id)
+		) WITHOUT ROWID`,
+		"CREATE INDEX links_to ON links (to_url_id)",
+		`CREATE TABLE authority (
+			url_id INTEGER NOT NULL PRIMARY KEY,
+			score REAL NOT NULL,
+			FOREIGN KEY (url_id) REFERENCES urls(id)
+		)`,
+		"ALTER TABLE urls ADD COLUMN index_version INTEGER NOT NULL DEFAULT 0",
+	)
+}
+
+// Version 7: the words of each url as they are written, lower cased, with
+// the term each is stemmed to, for wildcards. Urls indexed before this
+// version have none until they are indexed again.
+func addSurfaceForms(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE surface_forms (
+			form TEXT NOT NULL,
+			url_id INTEGER NOT NULL,
+			word_id INTEGER NOT NULL,
+			occurrences INTEGER NOT NULL,
+			PRIMARY KEY (form, url_id),
+			FOREIGN KEY (url_id) REFERENCES urls(id),
+			FOREIGN KEY (word_id) REFERENCES words(id)
+		) WITHOUT ROWID`,
+		"CREATE INDEX surface_forms_url ON surface_forms (url_id)",
+	)
+}
+
+// Version 8: the amount of terms of every url that has any, and the totals
+// of the whole corpus, so that ranking does not add them up for each search.
+func addURLStats(tx *sql.Tx) error {
+	return execAll(tx,
+		`CREATE TABLE url_stats (
+			url_id INTEGER NOT NULL PRIMARY KEY,
+			total_terms INTEGER NOT NULL,
+			FOREIGN KEY (url_id) REFERENCES urls(id)
+		)`,
+		`INSERT INTO url_stats (url_id, total_terms)
+			SELECT url_id, SUM(occurrences) FROM frequency GROUP BY url_id HAVING SUM(occurrences) > 0`,
+		`CREATE TABLE corpus_stats (
+			id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+			documents INTEGER NOT NULL,
+			total_terms INTEGER NOT NULL
+		)`,
+		"INSERT INTO corpus_stats (id, documents, total_terms) SELECT 1, COUNT(*), IFNULL(SUM(total_terms), 0) FROM url_stats",
+	)
+}
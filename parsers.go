@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+	"gopkg.in/neurosnap/sentences.v1/english"
+)
+
+// A DocumentParser extracts the title, links and sentences of a downloaded
+// document.
+type DocumentParser func(body []byte) (ExtractResult, error)
+
+// The parser for each supported media type.
+var documentParsers = map[string]DocumentParser{}
+
+// Returned for documents without a parser.
+type unsupportedTypeError struct {
+	mediaType string
+}
+
+func (e unsupportedTypeError) Error() string {
+	return "unsupported content type " + e.mediaType
+}
+
+func init() {
+	registerParser(parseHTML, "text/html", "application/xhtml+xml")
+	registerParser(parseText, "text/plain")
+	registerParser(parseMarkdown, "text/markdown", "text/x-markdown")
+	registerParser(parseXML, "application/xml", "text/xml", "application/rss+xml", "application/x-rss+xml", "application/atom+xml")
+	registerParser(parseJSON, "application/json", "application/ld+json", "application/feed+json")
+}
+
+// Use the parser for documents of the given media types.
+func registerParser(parser DocumentParser, mediaTypes ...string) {
+	for _, mediaType := range mediaTypes {
+		documentParsers[mediaType] = parser
+	}
+}
+
+// Route the download to the parser for its media type.
+func extract(dl *DownloadResult) (ExtractResult, error) {
+	mediaType := detectMediaType(dl.contentType, dl.item.url, dl.body)
+	parser, exists := documentParsers[mediaType]
+	if !exists {
+		return ExtractResult{}, unsupportedTypeError{mediaType: mediaType}
+	}
+	result, err := parser(dl.body)
+	if err != nil {
+		return result, fmt.Errorf("%w as %s: %v", ErrParse, mediaType, err)
+	}
+	return result, nil
+}
+
+// Used by the fetcher to skip reading bodies that no parser could handle.
+// Missing and generic types are accepted so that the body can be sniffed.
+func acceptContentType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		return nil
+	}
+	if _, exists := documentParsers[mediaType]; !exists {
+		return unsupportedTypeError{mediaType: mediaType}
+	}
+	return nil
+}
+
+// Returns the media type of the document from its Content-Type header,
+// falling back on sniffing the body. Markdown and JSON are often served as
+// plain text, so those are recognized by extension and content.
+func detectMediaType(contentType, rawUrl string, body []byte) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(body))
+	}
+
+	if mediaType == "text/plain" {
+		if parsedUrl, err := url.Parse(rawUrl); err == nil {
+			switch strings.ToLower(path.Ext(parsedUrl.Path)) {
+			case ".md", ".markdown":
+				return "text/markdown"
+			}
+		}
+		trimmed := bytes.TrimSpace(body)
+		if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return "application/json"
+		}
+	}
+	return mediaType
+}
+
+// Returns a function that splits text into trimmed, non-empty sentences.
+func newSentenceSplitter() (func(text string) []string, error) {
+	tokenizer, err := english.NewSentenceTokenizer(nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(text string) []string {
+		var sentences []string
+		for _, s := range tokenizer.Tokenize(strings.TrimSpace(text)) {
+			if sentence := strings.TrimSpace(s.Text); sentence != "" {
+				sentences = append(sentences, sentence)
+			}
+		}
+		return sentences
+	}, nil
+}
+
+// Returns the first line of the text, shortened to make a title.
+func firstLine(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if len(line) > 100 {
+				line = line[:100]
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// Plain text is split into paragraphs on blank lines. The first line is
+// used as the title.
+func parseText(body []byte) (ExtractResult, error) {
+	var result ExtractResult
+	splitSentences, err := newSentenceSplitter()
+	if err != nil {
+		return result, err
+	}
+
+	text := string(body)
+	result.title = firstLine(text)
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		result.sentences = append(result.sentences, splitSentences(paragraph)...)
+	}
+	return result, nil
+}
+
+var (
+	markdownLink     = regexp.MustCompile(`(!?)\[([^\]]*)\]\(\s*<?([^)\s>]+)>?[^)]*\)`)
+	markdownListItem = regexp.MustCompile(`^([-*+]|\d+[.)])\s+`)
+)
+
+// Markdown is stripped of its markup. Headings become sentences of their own,
+// the first one is used as the title, code blocks are skipped and the
+// targets of links are collected along with their text.
+func parseMarkdown(body []byte) (ExtractResult, error) {
+	var result ExtractResult
+	splitSentences, err := newSentenceSplitter()
+	if err != nil {
+		return result, err
+	}
+
+	var paragraph strings.Builder
+	flush := func() {
+		result.sentences = append(result.sentences, splitSentences(paragraph.String())...)
+		paragraph.Reset()
+	}
+
+	inCode := false
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~") {
+			inCode = !inCode
+			flush()
+			continue
+		}
+		if inCode {
+			continue
+		}
+
+		line = markdownLink.ReplaceAllStringFunc(line, func(link string) string {
+			match := markdownLink.FindStringSubmatch(link)
+			// Images only keep their alt text.
+			if match[1] == "" {
+				result.hrefs = append(result.hrefs, match[3])
+				result.anchors = append(result.anchors, Anchor{href: match[3], text: match[2]})
+			}
+			return match[2]
+		})
+		line = strings.TrimLeft(line, "> ")
+		line = markdownListItem.ReplaceAllString(line, "")
+		line = strings.NewReplacer("**", "", "__", "", "`", "").Replace(line)
+
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "#"):
+			flush()
+			heading := strings.TrimSpace(strings.Trim(line, "#"))
+			field := headingField
+			if result.title == "" {
+				result.title = heading
+				field = titleField
+			}
+			result.addSentences(field, splitSentences(heading)...)
+		default:
+			paragraph.WriteString(line + " ")
+		}
+	}
+	flush()
+
+	return result, nil
+}
+
+// XML documents, including RSS and Atom feeds, are indexed by their text.
+// The first <title> is used as the title, and links are taken from href
+// attributes and from <link> elements that hold a url.
+func parseXML(body []byte) (ExtractResult, error) {
+	var result ExtractResult
+	splitSentences, err := newSentenceSplitter()
+	if err != nil {
+		return result, err
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+
+	var current string
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return result, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+			for _, attr := range t.Attr {
+				if attr.Name.Local == "href" {
+					result.hrefs = append(result.hrefs, attr.Value)
+				}
+			}
+		case xml.EndElement:
+			current = ""
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" {
+				continue
+			}
+			switch current {
+			case "title":
+				if result.title == "" {
+					result.title = text
+					result.addSentences(titleField, splitSentences(text)...)
+					continue
+				}
+			case "link", "loc", "guid":
+				if isWebURL(text) {
+					result.hrefs = append(result.hrefs, text)
+					continue
+				}
+			}
+			// Feeds often escape the HTML of their descriptions.
+			if strings.Contains(text, "<") {
+				text = htmlText(text)
+			}
+			result.sentences = append(result.sentences, splitSentences(text)...)
+		}
+	}
+
+	return result, nil
+}
+
+// JSON documents are indexed by their string values. Strings holding a url
+// are collected as links, and a top-level "title" or "name" is used as the
+// title.
+func parseJSON(body []byte) (ExtractResult, error) {
+	var result ExtractResult
+	splitSentences, err := newSentenceSplitter()
+	if err != nil {
+		return result, err
+	}
+
+	var document any
+	if err := json.Unmarshal(body, &document); err != nil {
+		return result, err
+	}
+	if object, ok := document.(map[string]any); ok {
+		for _, key := range []string{"title", "name"} {
+			if title, ok := object[key].(string); ok && result.title == "" {
+				result.title = strings.TrimSpace(title)
+			}
+		}
+	}
+
+	var walk func(value any)
+	walk = func(value any) {
+		switch v := value.(type) {
+		case string:
+			if isWebURL(v) {
+				result.hrefs = append(result.hrefs, v)
+			} else {
+				result.sentences = append(result.sentences, splitSentences(v)...)
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]any:
+			// Keys are sorted so that the sentences keep a stable order.
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				walk(v[key])
+			}
+		}
+	}
+	walk(document)
+
+	return result, nil
+}
+
+// Reports whether the text is an absolute http(s) url.
+func isWebURL(text string) bool {
+	return strings.HasPrefix(text, "http://") || strings.HasPrefix(text, "https://")
+}
+
+// Returns the text content of an HTML fragment.
+func htmlText(fragment string) string {
+	tokenizer := html.NewTokenizer(strings.NewReader(fragment))
+	var text strings.Builder
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(text.String()), " ")
+		case html.TextToken:
+			text.Write(tokenizer.Text())
+			text.WriteByte(' ')
+		}
+	}
+}
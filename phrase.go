@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/kljensen/snowball"
+)
+
+// A phrase is a run of words that must occur in order. Stopwords are not
+// indexed, so only the other words are kept as terms, each with its offset
+// from the first term. "state of the art" becomes state at 0 and art at 3.
+type phrase struct {
+	terms   []string
+	offsets []int
+}
+
+// Stem the words of the text into a phrase, leaving out stopwords.
+func newPhrase(text string) phrase {
+	var p phrase
+	first := -1
+	for i, word := range splitWords(text) {
+		stemmedWord, err := snowball.Stem(word, "english", true)
+		if err != nil {
+			continue
+		}
+		if _, exists := StopWords[stemmedWord]; exists {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		p.terms = append(p.terms, stemmedWord)
+		p.offsets = append(p.offsets, i-first)
+	}
+	return p
+}
+
+// Returns where the phrase occurs, by url id. Each match is the position of
+// the first term of the phrase. A phrase of only stopwords matches nothing,
+// and a phrase never spans two sentences, which also keeps it from running
+// from one field into another.
+func (ebook *Index) matchPhrase(p phrase) (map[int][]Position, error) {
+	matches := make(map[int][]Position)
+	if len(p.terms) == 0 {
+		return matches, nil
+	}
+
+	// The sentence at each offset of every term of the phrase, by url.
+	var termOffsets []map[int]map[int]int
+	var first map[int][]Position
+	for i, term := range p.terms {
+		termID, err := ebook.store.findTerm(term)
+		if errors.Is(err, ErrNotFound) {
+			return matches, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		positions, err := ebook.store.positions(termID)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			first = positions
+			continue
+		}
+		offsets := make(map[int]map[int]int, len(positions))
+		for urlID, urlPositions := range positions {
+			offsets[urlID] = make(map[int]int, len(urlPositions))
+			for _, position := range urlPositions {
+				offsets[urlID][position.offset] = position.sentence
+			}
+		}
+		termOffsets = append(termOffsets, offsets)
+	}
+
+	for urlID, positions := range first {
+		for _, position := range positions {
+			matched := true
+			for i, offsets := range termOffsets {
+				sentence, exists := offsets[urlID][position.offset+p.offsets[i+1]]
+				if !exists || sentence != position.sentence {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				matches[urlID] = append(matches[urlID], position)
+			}
+		}
+	}
+	return matches, nil
+}
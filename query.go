@@ -0,0 +1,512 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Queries are written in a small boolean language:
+//
+//	query   = or
+//	or      = and { "OR" and }
+//	and     = bag { "AND" bag }
+//	bag     = unary { unary }
+//	unary   = ( "NOT" | "-" ) unary | primary
+//	primary = "(" or ")" | "\"" phrase "\"" | pattern | word
+//
+// Operators are upper case, so "not" and "or" are ordinary words. A pattern
+// is a word with wildcards, where * stands for any letters and ? for one, as
+// in colo?r or *script, and matches words as they are written on pages
+// rather than as they are stemmed. Words next to each other form a bag, which matches pages with any of its words
+// or, when it has quoted phrases, pages with every phrase. NOT and - leave
+// out the pages that match, so they need something to leave them out of,
+// as in (gpt OR llama) AND safety -policy.
+type queryNode struct {
+	kind nodeKind
+	// The word, phrase or pattern of a leaf.
+	text     string
+	children []*queryNode
+}
+
+type nodeKind int
+
+const (
+	termNode nodeKind = iota
+	phraseNode
+	patternNode
+	andNode
+	orNode
+	notNode
+	bagNode
+)
+
+// Returned for malformed queries. The message is shown to the user.
+type queryError struct {
+	message string
+}
+
+func (e queryError) Error() string {
+	return e.message
+}
+
+func (e queryError) Unwrap() error {
+	return ErrParse
+}
+
+type tokenKind int
+
+const (
+	wordToken tokenKind = iota
+	phraseToken
+	openToken
+	closeToken
+	andToken
+	orToken
+	notToken
+)
+
+type queryToken struct {
+	kind tokenKind
+	text string
+}
+
+// Reports whether the query uses any of the syntax of the query language,
+// as opposed to being a plain word or two.
+func isBooleanQuery(query string) bool {
+	words := strings.Fields(query)
+	if !isBagOfWords(query) || len(words) > 2 {
+		return true
+	}
+	for _, word := range words {
+		if isPattern(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the query is only words, without quotes, parentheses or
+// operators. The words may be wildcards.
+func isBagOfWords(query string) bool {
+	if strings.ContainsAny(query, `"()`) {
+		return false
+	}
+	for _, word := range strings.Fields(query) {
+		if word == "AND" || word == "OR" || word == "NOT" || (len(word) > 1 && strings.HasPrefix(word, "-")) {
+			return false
+		}
+	}
+	return true
+}
+
+// Split the query into tokens.
+func tokenizeQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, queryToken{kind: openToken})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{kind: closeToken})
+			i++
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				return nil, queryError{"missing closing quote"}
+			}
+			tokens = append(tokens, queryToken{kind: phraseToken, text: query[i+1 : i+1+end]})
+			i += end + 2
+		case c == '-' && i+1 < len(query) && !unicode.IsSpace(rune(query[i+1])):
+			// A dash in front of something leaves it out.
+			tokens = append(tokens, queryToken{kind: notToken})
+			i++
+		default:
+			end := strings.IndexFunc(query[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+			})
+			if end < 0 {
+				end = len(query) - i
+			}
+			word := query[i : i+end]
+			switch word {
+			case "AND":
+				tokens = append(tokens, queryToken{kind: andToken})
+			case "OR":
+				tokens = append(tokens, queryToken{kind: orToken})
+			case "NOT":
+				tokens = append(tokens, queryToken{kind: notToken})
+			default:
+				tokens = append(tokens, queryToken{kind: wordToken, text: word})
+			}
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	next   int
+}
+
+// Parse the query into a tree. Words that are only stopwords are left out,
+// so the tree is nil when nothing is left to search for.
+func parseQuery(query string) (*queryNode, error) {
+	tokens, err := tokenizeQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, queryError{"the search is empty"}
+	}
+	parser := &queryParser{tokens: tokens}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.next < len(parser.tokens) {
+		return nil, queryError{"unexpected )"}
+	}
+	return node, nil
+}
+
+// Returns the kind of the next token, and whether there is one.
+func (parser *queryParser) peek() (tokenKind, bool) {
+	if parser.next >= len(parser.tokens) {
+		return 0, false
+	}
+	return parser.tokens[parser.next].kind, true
+}
+
+func (parser *queryParser) parseOr() (*queryNode, error) {
+	return parser.parseBinary(orNode, orToken, parser.parseAnd)
+}
+
+func (parser *queryParser) parseAnd() (*queryNode, error) {
+	return parser.parseBinary(andNode, andToken, parser.parseBag)
+}
+
+// Parse operands separated by the operator.
+func (parser *queryParser) parseBinary(kind nodeKind, operator tokenKind, parseOperand func() (*queryNode, error)) (*queryNode, error) {
+	var children []*queryNode
+	for {
+		if err := parser.expectOperand(); err != nil {
+			return nil, err
+		}
+		child, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if next, ok := parser.peek(); !ok || next != operator {
+			return combine(kind, children), nil
+		}
+		parser.next++
+	}
+}
+
+func (parser *queryParser) parseBag() (*queryNode, error) {
+	var children []*queryNode
+	for {
+		child, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+		if next, ok := parser.peek(); !ok || !startsOperand(next) {
+			return combine(bagNode, children), nil
+		}
+	}
+}
+
+func (parser *queryParser) parseUnary() (*queryNode, error) {
+	if next, _ := parser.peek(); next != notToken {
+		return parser.parsePrimary()
+	}
+	parser.next++
+	if next, ok := parser.peek(); !ok || !startsOperand(next) {
+		return nil, queryError{"NOT needs something to leave out"}
+	}
+	child, err := parser.parseUnary()
+	if err != nil || child == nil {
+		return nil, err
+	}
+	return &queryNode{kind: notNode, children: []*queryNode{child}}, nil
+}
+
+func (parser *queryParser) parsePrimary() (*queryNode, error) {
+	token := parser.tokens[parser.next]
+	parser.next++
+	switch token.kind {
+	case openToken:
+		if next, ok := parser.peek(); ok && next == closeToken {
+			return nil, queryError{"the parentheses are empty"}
+		}
+		node, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if next, ok := parser.peek(); !ok || next != closeToken {
+			return nil, queryError{"missing closing parenthesis"}
+		}
+		parser.next++
+		return node, nil
+	case phraseToken:
+		return newLeaf(phraseNode, token.text), nil
+	default:
+		if isPattern(token.text) {
+			if err := checkPattern(token.text); err != nil {
+				return nil, err
+			}
+			return &queryNode{kind: patternNode, text: strings.ToLower(token.text)}, nil
+		}
+		return newLeaf(termNode, token.text), nil
+	}
+}
+
+// Returns an error saying what is wrong when the next token cannot start an
+// operand.
+func (parser *queryParser) expectOperand() error {
+	next, ok := parser.peek()
+	switch {
+	case !ok && parser.next == 0:
+		return queryError{"the search is empty"}
+	case !ok:
+		previous := parser.tokens[parser.next-1].kind
+		if previous == openToken {
+			return queryError{"missing closing parenthesis"}
+		}
+		return queryError{operatorName(previous) + " needs something to search for on both sides"}
+	case next == andToken, next == orToken:
+		return queryError{operatorName(next) + " needs something to search for on both sides"}
+	case next == closeToken:
+		return queryError{"unexpected )"}
+	}
+	return nil
+}
+
+func operatorName(kind tokenKind) string {
+	switch kind {
+	case andToken:
+		return "AND"
+	case orToken:
+		return "OR"
+	}
+	return "NOT"
+}
+
+// Reports whether a token of the kind can start an operand.
+func startsOperand(kind tokenKind) bool {
+	return kind == wordToken || kind == phraseToken || kind == openToken || kind == notToken
+}
+
+// Returns a leaf for the word or phrase, or nil when it is only stopwords.
+func newLeaf(kind nodeKind, text string) *queryNode {
+	if len(newPhrase(text).terms) == 0 {
+		return nil
+	}
+	return &queryNode{kind: kind, text: text}
+}
+
+// Returns a node of the kind with the children that are not nil. A single
+// child is returned as it is.
+func combine(kind nodeKind, children []*queryNode) *queryNode {
+	var kept []*queryNode
+	for _, child := range children {
+		if child != nil {
+			kept = append(kept, child)
+		}
+	}
+	switch len(kept) {
+	case 0:
+		return nil
+	case 1:
+		return kept[0]
+	}
+	return &queryNode{kind: kind, children: kept}
+}
+
+// Evaluates a query tree. Every leaf that is not left out is kept as a part,
+// with where it matched, so that the results can be scored and the snippets
+// chosen.
+type queryEvaluator struct {
+	ebook *Index
+	parts []queryPart
+	// What each pattern was expanded to.
+	expansions []Expansion
+}
+
+// Returns the urls that match the node. negated is set under a NOT, where
+// the leaves are not used for scoring.
+func (eval *queryEvaluator) evaluate(node *queryNode, negated bool) (map[int]struct{}, error) {
+	switch node.kind {
+	case termNode, phraseNode, patternNode:
+		part, err := eval.matchLeaf(node, negated)
+		if err != nil {
+			return nil, err
+		}
+		if !negated {
+			eval.parts = append(eval.parts, part)
+		}
+		urls := make(map[int]struct{}, len(part.matches))
+		for urlID := range part.matches {
+			urls[urlID] = struct{}{}
+		}
+		return urls, nil
+
+	case orNode:
+		urls := make(map[int]struct{})
+		for _, child := range node.children {
+			childURLs, err := eval.evaluate(child, negated)
+			if err != nil {
+				return nil, err
+			}
+			for urlID := range childURLs {
+				urls[urlID] = struct{}{}
+			}
+		}
+		return urls, nil
+
+	case andNode, bagNode:
+		// Every operand of AND is required. In a bag the phrases are
+		// required when there are any, and otherwise any word will do.
+		var required, optional []*queryNode
+		var excluded []*queryNode
+		for _, child := range node.children {
+			switch {
+			case child.kind == notNode:
+				excluded = append(excluded, child.children[0])
+			case child.kind == bagNode && onlyNegated(child):
+				// As in safety AND -policy -ethics.
+				for _, negated := range child.children {
+					excluded = append(excluded, negated.children[0])
+				}
+			case node.kind == andNode || child.kind == phraseNode:
+				required = append(required, child)
+			default:
+				optional = append(optional, child)
+			}
+		}
+		if len(required) == 0 && len(optional) == 0 {
+			return nil, queryError{"NOT needs something to leave out from, as in safety -policy"}
+		}
+
+		var urls map[int]struct{}
+		for _, child := range required {
+			childURLs, err := eval.evaluate(child, negated)
+			if err != nil {
+				return nil, err
+			}
+			if urls == nil {
+				urls = childURLs
+				continue
+			}
+			for urlID := range urls {
+				if _, exists := childURLs[urlID]; !exists {
+					delete(urls, urlID)
+				}
+			}
+		}
+		for _, child := range optional {
+			childURLs, err := eval.evaluate(child, negated)
+			if err != nil {
+				return nil, err
+			}
+			// Optional words only add urls when nothing is required.
+			if len(required) == 0 {
+				if urls == nil {
+					urls = make(map[int]struct{})
+				}
+				for urlID := range childURLs {
+					urls[urlID] = struct{}{}
+				}
+			}
+		}
+		for _, child := range excluded {
+			childURLs, err := eval.evaluate(child, true)
+			if err != nil {
+				return nil, err
+			}
+			for urlID := range childURLs {
+				delete(urls, urlID)
+			}
+		}
+		return urls, nil
+
+	default:
+		return nil, queryError{"NOT needs something to leave out from, as in safety -policy"}
+	}
+}
+
+// Reports whether every child of the node is negated.
+func onlyNegated(node *queryNode) bool {
+	for _, child := range node.children {
+		if child.kind != notNode {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the part for the leaf. Leaves under a NOT are only matched, since
+// they are not scored.
+func (eval *queryEvaluator) matchLeaf(node *queryNode, negated bool) (queryPart, error) {
+	var part queryPart
+	var err error
+	if node.kind != patternNode {
+		p := newPhrase(node.text)
+		part.terms = p.terms
+		if part.matches, err = eval.ebook.matchPhrase(p); err != nil || negated {
+			return part, err
+		}
+		part.anchors, err = eval.ebook.anchorCounts(part.terms, true)
+		return part, err
+	}
+
+	expansion, err := eval.ebook.expandPattern(node.text)
+	if err != nil {
+		return part, err
+	}
+	eval.expansions = append(eval.expansions, expansion)
+	part.terms = expansion.terms
+	part.matches = make(map[int][]Position)
+	for _, term := range part.terms {
+		termMatches, err := eval.ebook.matchPhrase(phrase{terms: []string{term}, offsets: []int{0}})
+		if err != nil {
+			return part, err
+		}
+		for urlID, positions := range termMatches {
+			part.matches[urlID] = append(part.matches[urlID], positions...)
+		}
+	}
+	for _, positions := range part.matches {
+		sort.Slice(positions, func(i, j int) bool { return positions[i].offset < positions[j].offset })
+	}
+	if negated {
+		return part, nil
+	}
+	part.anchors, err = eval.ebook.anchorCounts(part.terms, false)
+	return part, err
+}
+
+// Search for a query written in the query language. The matching pages are
+// ranked by the sum of the scores of each word, phrase and pattern of the
+// query that they contain.
+func (ebook *Index) booleanSearch(query string, options SearchOptions) (searchResults, error) {
+	node, err := parseQuery(query)
+	if err != nil || node == nil {
+		return searchResults{}, err
+	}
+	eval := &queryEvaluator{ebook: ebook}
+	urls, err := eval.evaluate(node, false)
+	if err != nil {
+		return searchResults{}, err
+	}
+	found, err := ranked(ebook.rankURLs(urls, eval.parts, options))
+	found.expansions = eval.expansions
+	return found, err
+}
@@ -1,95 +1,359 @@
 package main
 
 import (
-	"encoding/xml"
+	"bufio"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Urlset struct {
-	Urls []string `xml:"url>loc"`
-}
-
-func (ebook *Index) createRobotMap(currentUrl string) {
-	ebook.robots = make(map[string]rules)
-	if parsedUrl, err := url.Parse(currentUrl); err == nil {
-		// creating robots.txt url
-		// localhost:8080/robots.txt
-		robotsUrl := parsedUrl.Scheme + "://" + parsedUrl.Host + "/robots.txt"
-		if rsp, err := http.Get(robotsUrl); err == nil {
-			if robotsData, err := io.ReadAll(rsp.Body); err == nil {
-				lines := strings.Split(string(robotsData), "\n")
-				currentUser := ""
-
-				for _, line := range lines {
-					pieces := strings.Split(line, " ")
-					if len(pieces) < 2 {
-						continue
-					}
-					UAD := strings.ToLower(pieces[0])
-					value := strings.TrimSpace(pieces[1])
-					value = strings.ReplaceAll(value, "*", ".*")
-
-					switch UAD {
-					case "user-agent:":
-						// fmt.Println("User agent:", value)
-						currentUser = value
-					case "allow:":
-						// fmt.Println("Allow:", value)
-						currentRules := ebook.robots[currentUser]
-						currentRules.allowed = append(currentRules.allowed, value)
-						ebook.robots[currentUser] = currentRules
-					case "disallow:":
-						// fmt.Println("Disallow:", value)
-						currentRules := ebook.robots[currentUser]
-						currentRules.disallowed = append(currentRules.disallowed, value)
-						ebook.robots[currentUser] = currentRules
-					case "crawl-delay:":
-						// fmt.Println("Delay:", value)
-						if num, err := strconv.Atoi(value); err == nil {
-							currentRules := ebook.robots[currentUser]
-							currentRules.delay = num
-							ebook.robots[currentUser] = currentRules
-						}
-					case "sitemap:":
-						ebook.downloadSitemap(value)
-					}
-				}
-			} else {
-				log.Fatalf("Could not read data %v", err)
+// A single Allow or Disallow line of a robots.txt file.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// The rules that apply to one or more user-agents.
+type robotsGroup struct {
+	agents []string
+	rules  []robotsRule
+	delay  time.Duration
+}
+
+// A parsed robots.txt file, as described by RFC 9309.
+type robotsTxt struct {
+	groups   []*robotsGroup
+	sitemaps []string
+}
+
+// Parse a robots.txt file. Lines that cannot be understood are ignored, as
+// are rules that appear before the first User-agent line.
+func parseRobots(r io.Reader) *robotsTxt {
+	robots := &robotsTxt{}
+	var current *robotsGroup
+	// Consecutive User-agent lines share the group that follows them.
+	lastWasAgent := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !lastWasAgent {
+				current = &robotsGroup{}
+				robots.groups = append(robots.groups, current)
 			}
-		} else {
-			log.Fatalf("Could not download robots.txt %v", err)
+			current.agents = append(current.agents, agentToken(value))
+			lastWasAgent = true
+		case "allow", "disallow":
+			// An empty Disallow allows everything, so it adds nothing.
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: normalizeRobotsPath(value)})
+			}
+			lastWasAgent = false
+		case "crawl-delay":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && current != nil && seconds >= 0 {
+				current.delay = time.Duration(seconds * float64(time.Second))
+			}
+			lastWasAgent = false
+		case "sitemap":
+			// Sitemaps do not belong to a group.
+			robots.sitemaps = append(robots.sitemaps, value)
 		}
-	} else {
-		log.Fatalf("Error parsing %v", err)
 	}
+
+	return robots
 }
 
-func (ebook *Index) downloadSitemap(sitemap string) {
-	if response, err := http.Get(sitemap); err == nil {
-		defer response.Body.Close()
-		if xmlData, err := io.ReadAll(response.Body); err == nil {
-			var urlset Urlset
+// Returns the lower-cased product token of a user-agent, so that
+// "ExampleBot/1.0" and "examplebot" are the same agent.
+func agentToken(userAgent string) string {
+	if i := strings.IndexAny(userAgent, "/ \t"); i >= 0 {
+		userAgent = userAgent[:i]
+	}
+	return strings.ToLower(userAgent)
+}
 
-			err = xml.Unmarshal(xmlData, &urlset)
-			if err != nil {
-				log.Fatalf("Could not unmarshal xml: %v", err)
-			}
+// Returns the rules for the given user-agent product token. Every group that
+// names the token is merged together; if none do, the "*" groups are used.
+// Returns nil when no group applies, which allows everything.
+func (robots *robotsTxt) rulesFor(userAgent string) *robotsGroup {
+	userAgent = agentToken(userAgent)
+	var matched, wildcard *robotsGroup
+	merge := func(into **robotsGroup, group *robotsGroup) {
+		if *into == nil {
+			*into = &robotsGroup{}
+		}
+		(*into).agents = append((*into).agents, group.agents...)
+		(*into).rules = append((*into).rules, group.rules...)
+		if group.delay > (*into).delay {
+			(*into).delay = group.delay
+		}
+	}
 
-			for _, url := range urlset.Urls {
-				ebook.crawlDatabase(url)
-			}
+	for _, group := range robots.groups {
+		// A group that names the token as well as "*" belongs to the token,
+		// wherever in the group it is named.
+		named, star := false, false
+		for _, agent := range group.agents {
+			named = named || agent == userAgent
+			star = star || agent == "*"
+		}
+		if named {
+			merge(&matched, group)
+		} else if star {
+			merge(&wildcard, group)
+		}
+	}
 
-		} else {
-			log.Fatalf("Could not read response body %v", err)
+	if matched != nil {
+		return matched
+	}
+	return wildcard
+}
+
+// Reports whether the path (including any query) may be crawled. The rule
+// with the longest matching pattern wins, and Allow wins ties.
+func (group *robotsGroup) allowed(path string) bool {
+	path = normalizeRobotsPath(path)
+	if group == nil || path == "/robots.txt" {
+		return true
+	}
+
+	allow := true
+	longest := -1
+	for _, rule := range group.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allow = rule.allow
+		}
+	}
+	return allow
+}
+
+// Percent-encode the characters that must be encoded in a url path and
+// upper-case existing escapes, so that patterns and paths compare equally.
+func normalizeRobotsPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '%' && i+2 < len(path) && isHex(path[i+1]) && isHex(path[i+2]):
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(path[i+1 : i+3]))
+			i += 2
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
 		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
 
+// Reports whether the robots.txt pattern matches the start of the path. "*"
+// matches any sequence of characters and a trailing "$" anchors the pattern
+// to the end of the path.
+func robotsMatch(pattern, path string) bool {
+	if strings.HasSuffix(pattern, "$") {
+		pattern = pattern[:len(pattern)-1]
 	} else {
-		log.Fatalf("Could not http get sitemap %v", err)
+		pattern += "*"
+	}
+
+	// Match greedily, going back to the last "*" on a mismatch.
+	p, s := 0, 0
+	star, mark := -1, 0
+	for s < len(path) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, mark = p, s
+			p++
+		} else if p < len(pattern) && pattern[p] == path[s] {
+			p++
+			s++
+		} else if star >= 0 {
+			mark++
+			p, s = star+1, mark
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// The cached robots.txt of a single host. ready is closed once the file has
+// been fetched, so that concurrent lookups wait for the same download.
+type robotsEntry struct {
+	ready    chan struct{}
+	rules    *robotsGroup
+	sitemaps []string
+	// Why robots.txt could not be downloaded, in which case every url of
+	// the host is disallowed until the entry expires.
+	err     error
+	expires time.Time
+}
+
+// robotsCache fetches the robots.txt of every scheme and host the crawl
+// visits the first time it is needed, and keeps the rules for our
+// user-agent until they expire.
+type robotsCache struct {
+	mu        sync.Mutex
+	entries   map[string]*robotsEntry
+	ttl       time.Duration
+	userAgent string
+	client    *http.Client
+}
+
+// Rules that disallow every path, used when robots.txt is unavailable.
+var disallowAll = &robotsGroup{rules: []robotsRule{{allow: false, pattern: "/"}}}
+
+// Parsers must read at least 500 KiB of a robots.txt file.
+const maxRobotsSize = 500 * 1024
+
+// How long a robots.txt that could not be downloaded is cached before it is
+// tried again, as unreachable hosts and server errors are often soon over.
+const robotsRetryInterval = time.Minute
+
+func newRobotsCache(config Config) *robotsCache {
+	return &robotsCache{
+		entries:   make(map[string]*robotsEntry),
+		ttl:       config.robotsTTL,
+		userAgent: config.userAgent,
+		client:    &http.Client{Timeout: config.timeout},
+	}
+}
+
+// Returns the cached robots.txt of the url's host, downloading it if it is
+// missing or has expired.
+func (cache *robotsCache) entry(u *url.URL) *robotsEntry {
+	key := strings.ToLower(u.Scheme + "://" + u.Host)
+
+	cache.mu.Lock()
+	entry, exists := cache.entries[key]
+	if exists {
+		select {
+		case <-entry.ready:
+			// A finished entry is only reused until it expires.
+			exists = time.Now().Before(entry.expires)
+		default:
+			// Another goroutine is still downloading it.
+		}
+	}
+	if !exists {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		cache.entries[key] = entry
+	}
+	cache.mu.Unlock()
+
+	if exists {
+		<-entry.ready
+		return entry
+	}
+
+	entry.rules, entry.sitemaps, entry.err = cache.download(key + "/robots.txt")
+	ttl := cache.ttl
+	if entry.err != nil {
+		ttl = min(ttl, robotsRetryInterval)
+	}
+	entry.expires = time.Now().Add(ttl)
+	close(entry.ready)
+	return entry
+}
+
+// Download and parse a robots.txt file. A 4xx response allows everything,
+// while a 5xx response or an unreachable host disallows everything and
+// returns why.
+func (cache *robotsCache) download(robotsUrl string) (*robotsGroup, []string, error) {
+	req, err := http.NewRequest(http.MethodGet, robotsUrl, nil)
+	if err != nil {
+		return disallowAll, nil, fmt.Errorf("could not download %s: %w", robotsUrl, err)
+	}
+	req.Header.Set("User-Agent", cache.userAgent)
+
+	rsp, err := cache.client.Do(req)
+	if err != nil {
+		return disallowAll, nil, fmt.Errorf("could not download %s: %w", robotsUrl, err)
+	}
+	defer rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode >= 500:
+		return disallowAll, nil, fmt.Errorf("could not download %s: %w", robotsUrl, statusError{code: rsp.StatusCode})
+	case rsp.StatusCode >= 400:
+		return nil, nil, nil
+	}
+	robots := parseRobots(io.LimitReader(rsp.Body, maxRobotsSize))
+	return robots.rulesFor(cache.userAgent), robots.sitemaps, nil
+}
+
+// Returns the rules that apply to the url.
+func (cache *robotsCache) rules(u *url.URL) *robotsGroup {
+	return cache.entry(u).rules
+}
+
+// Returns errRobotsDisallowed when robots.txt does not allow the url to be
+// crawled, saying why when robots.txt could not be downloaded.
+func (cache *robotsCache) check(u *url.URL) error {
+	entry := cache.entry(u)
+	if entry.err != nil {
+		return fmt.Errorf("%w: %v", errRobotsDisallowed, entry.err)
+	}
+	if !entry.rules.allowed(u.RequestURI()) {
+		return errRobotsDisallowed
+	}
+	return nil
+}
+
+// Returns how long to wait between requests to the url's host.
+func (cache *robotsCache) crawlDelay(u *url.URL) time.Duration {
+	// If robots.txt did not set a delay, wait 100ms.
+	rules := cache.rules(u)
+	if rules == nil || rules.delay == 0 {
+		return 100 * time.Millisecond
+	}
+	return rules.delay
+}
+
+// Queue the pages of every sitemap listed in the robots.txt of the url's
+// host.
+func (ebook *Index) createRobotMap(currentUrl string) error {
+	parsedUrl, err := url.Parse(currentUrl)
+	if err != nil {
+		return fmt.Errorf("could not parse seed %s: %w: %v", currentUrl, ErrParse, err)
+	}
+	for _, sitemap := range ebook.robots.entry(parsedUrl).sitemaps {
+		if err := ebook.downloadSitemap(sitemap); err != nil {
+			return err
+		}
 	}
+	return nil
 }
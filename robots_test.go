@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRobots(t *testing.T) {
+	robots := parseRobots(strings.NewReader(`# A comment line
+Disallow: /before-any-agent
+USER-AGENT: ExampleBot/1.0 # the version is ignored
+user-agent: other
+DisAllow: /private # a trailing comment
+Allow: /private/open
+Disallow:
+Crawl-delay: 1.5
+
+User-agent: *
+Disallow: /tmp%7e/a b
+Sitemap: https://example.com/sitemap.xml
+not a rule
+`))
+
+	if len(robots.groups) != 2 {
+		t.Fatalf("got %d groups, want 2", len(robots.groups))
+	}
+	first := robots.groups[0]
+	if got := strings.Join(first.agents, ","); got != "examplebot,other" {
+		t.Errorf("agents of the first group are %q, want %q", got, "examplebot,other")
+	}
+	wantRules := []robotsRule{{allow: false, pattern: "/private"}, {allow: true, pattern: "/private/open"}}
+	if len(first.rules) != len(wantRules) {
+		t.Fatalf("first group has rules %v, want %v", first.rules, wantRules)
+	}
+	for i, rule := range wantRules {
+		if first.rules[i] != rule {
+			t.Errorf("rule %d is %v, want %v", i, first.rules[i], rule)
+		}
+	}
+	if first.delay != 1500*time.Millisecond {
+		t.Errorf("crawl delay is %v, want 1.5s", first.delay)
+	}
+
+	second := robots.groups[1]
+	if len(second.rules) != 1 || second.rules[0].pattern != "/tmp%7E/a%20b" {
+		t.Errorf("second group has rules %v, want a normalized /tmp%%7E/a%%20b", second.rules)
+	}
+	if len(robots.sitemaps) != 1 || robots.sitemaps[0] != "https://example.com/sitemap.xml" {
+		t.Errorf("sitemaps are %v", robots.sitemaps)
+	}
+}
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/", "/anything", true},
+		{"/fish", "/fish", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish.html", false},
+		{"/fish", "/catfish", false},
+		{"/fish/", "/fish", false},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/folder/index.php?q=1", true},
+		{"/*.php", "/index.html", false},
+		{"/fish*", "/fishheads", true},
+		{"/a*b*c", "/a-b-b-c", true},
+		{"/a*b*c", "/a-c-b", false},
+		{"/*.php$", "/index.php", true},
+		{"/*.php$", "/index.php?q=1", false},
+		{"/fish$", "/fish", true},
+		{"/fish$", "/fish/", false},
+		{"/$", "/", true},
+		{"/$", "/a", false},
+		{"*", "/", true},
+	}
+	for _, test := range tests {
+		if got := robotsMatch(test.pattern, test.path); got != test.want {
+			t.Errorf("robotsMatch(%q, %q) = %v, want %v", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRobotsAllowed(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []robotsRule
+		path  string
+		want  bool
+	}{
+		{"no rules", nil, "/a", true},
+		{"no match", []robotsRule{{false, "/a"}}, "/b", true},
+		{"disallowed", []robotsRule{{false, "/a"}}, "/a/b", false},
+		{"longest match allows", []robotsRule{{false, "/a"}, {true, "/a/b"}}, "/a/b/c", true},
+		{"longest match disallows", []robotsRule{{true, "/a"}, {false, "/a/b"}}, "/a/b/c", false},
+		{"longest match is by pattern, not order", []robotsRule{{true, "/a/b"}, {false, "/a"}}, "/a/b", true},
+		{"allow wins ties", []robotsRule{{false, "/a"}, {true, "/a"}}, "/a", true},
+		{"allow wins ties in either order", []robotsRule{{true, "/a"}, {false, "/a"}}, "/a", true},
+		{"wildcard", []robotsRule{{false, "/*.pdf$"}}, "/docs/x.pdf", false},
+		{"anchored", []robotsRule{{false, "/*.pdf$"}}, "/docs/x.pdf?v=1", true},
+		{"query", []robotsRule{{false, "/search?"}}, "/search?q=go", false},
+		{"robots.txt is always allowed", []robotsRule{{false, "/"}}, "/robots.txt", true},
+		{"escapes compare equally", []robotsRule{{false, "/%7Ejoe"}}, "/%7ejoe/page", false},
+		{"empty path is the root", []robotsRule{{false, "/$"}}, "", false},
+	}
+	for _, test := range tests {
+		group := &robotsGroup{rules: test.rules}
+		if got := group.allowed(test.path); got != test.want {
+			t.Errorf("%s: allowed(%q) = %v, want %v", test.name, test.path, got, test.want)
+		}
+	}
+
+	var none *robotsGroup
+	if !none.allowed("/a") {
+		t.Error("no group should allow everything")
+	}
+	if disallowAll.allowed("/a") {
+		t.Error("disallowAll should disallow every path")
+	}
+}
+
+func TestRobotsRulesFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		robots  string
+		allowed []string
+		blocked []string
+	}{
+		{
+			name:    "every group naming the agent is merged",
+			robots:  "User-agent: *\nUser-agent: project06\nDisallow: /a\n\nUser-agent: project06\nDisallow: /b",
+			allowed: []string{"/c"},
+			blocked: []string{"/a", "/b"},
+		},
+		{
+			name:    "the agent is named after another agent",
+			robots:  "User-agent: other\nUser-agent: project06\nDisallow: /a",
+			allowed: []string{"/b"},
+			blocked: []string{"/a"},
+		},
+		{
+			name:    "a named group replaces the star groups",
+			robots:  "User-agent: *\nDisallow: /\n\nUser-agent: project06\nDisallow: /private",
+			allowed: []string{"/", "/public"},
+			blocked: []string{"/private"},
+		},
+		{
+			name:    "the star groups are merged when the agent is not named",
+			robots:  "User-agent: *\nDisallow: /a\n\nUser-agent: other\nDisallow: /\n\nUser-agent: *\nDisallow: /b",
+			allowed: []string{"/c"},
+			blocked: []string{"/a", "/b"},
+		},
+		{
+			name:    "agents are matched without case or version",
+			robots:  "User-agent: Project06/2.1\nDisallow: /a",
+			blocked: []string{"/a"},
+		},
+		{
+			name:    "agents are matched by the whole token",
+			robots:  "User-agent: project\nDisallow: /\n\nUser-agent: project06bot\nDisallow: /",
+			allowed: []string{"/a"},
+		},
+		{
+			name:    "comments do not end a group",
+			robots:  "User-agent: project06\n# Disallow: /a\nDisallow: /b # not /c",
+			allowed: []string{"/a", "/c"},
+			blocked: []string{"/b"},
+		},
+		{
+			name:    "no groups",
+			robots:  "Sitemap: https://example.com/sitemap.xml",
+			allowed: []string{"/", "/a"},
+		},
+	}
+	for _, test := range tests {
+		rules := parseRobots(strings.NewReader(test.robots)).rulesFor("project06")
+		for _, path := range test.allowed {
+			if !rules.allowed(path) {
+				t.Errorf("%s: %s is disallowed, want allowed", test.name, path)
+			}
+		}
+		for _, path := range test.blocked {
+			if rules.allowed(path) {
+				t.Errorf("%s: %s is allowed, want disallowed", test.name, path)
+			}
+		}
+	}
+}
+
+func TestRobotsRulesForCrawlDelay(t *testing.T) {
+	robots := parseRobots(strings.NewReader("User-agent: project06\nCrawl-delay: 1\n\nUser-agent: project06\nCrawl-delay: 3\n\nUser-agent: *\nCrawl-delay: 10"))
+	if delay := robots.rulesFor("project06").delay; delay != 3*time.Second {
+		t.Errorf("crawl delay is %v, want the longest delay of the groups naming the agent, 3s", delay)
+	}
+	if delay := robots.rulesFor("other").delay; delay != 10*time.Second {
+		t.Errorf("crawl delay of another agent is %v, want 10s", delay)
+	}
+}
+
+func TestRobotsCacheRetriesFailures(t *testing.T) {
+	// The status robots.txt is served with.
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("User-agent: *\nDisallow: /private\n"))
+	}))
+	defer server.Close()
+
+	cache := newRobotsCache(Config{robotsTTL: time.Hour, userAgent: "project06", timeout: time.Second})
+	page, _ := url.Parse(server.URL + "/page")
+	private, _ := url.Parse(server.URL + "/private")
+	expiresIn := func() time.Duration {
+		return time.Until(cache.entry(page).expires)
+	}
+
+	// A server error disallows every url, says why, and is tried again soon.
+	err := cache.check(page)
+	if !errors.Is(err, errRobotsDisallowed) || !strings.Contains(err.Error(), "503") {
+		t.Errorf("check with a 503 robots.txt = %v, want a disallowed error naming the status", err)
+	}
+	if expires := expiresIn(); expires > robotsRetryInterval {
+		t.Errorf("a failed robots.txt is cached for %v, want at most %v", expires, robotsRetryInterval)
+	}
+
+	// Once it is tried again, the rules are cached for the whole TTL.
+	status = http.StatusOK
+	cache.entry(page).expires = time.Now()
+	if err := cache.check(page); err != nil {
+		t.Errorf("check of an allowed url = %v, want nil", err)
+	}
+	if err := cache.check(private); !errors.Is(err, errRobotsDisallowed) {
+		t.Errorf("check of a disallowed url = %v, want errRobotsDisallowed", err)
+	}
+	if expires := expiresIn(); expires <= robotsRetryInterval {
+		t.Errorf("a downloaded robots.txt is cached for %v, want the TTL", expires)
+	}
+
+	// A missing robots.txt allows everything for the whole TTL.
+	status = http.StatusNotFound
+	cache.entry(page).expires = time.Now()
+	if err := cache.check(private); err != nil {
+		t.Errorf("check with a 404 robots.txt = %v, want nil", err)
+	}
+	if expires := expiresIn(); expires <= robotsRetryInterval {
+		t.Errorf("a missing robots.txt is cached for %v, want the TTL", expires)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// A Scorer scores how well a document matches one term or phrase of a query.
+// The score of a document is the sum of the scores of the parts it matches.
+// The occurrences are weighted by the field they are in, so they need not be
+// whole.
+type Scorer interface {
+	score(occurrences float64, docLength, docsWithTerm int, corpus Corpus) float64
+}
+
+// What the scorers know about the whole index.
+type Corpus struct {
+	documents     int
+	averageLength float64
+}
+
+// The names the scorers can be chosen by.
+var scorerNames = []string{"tfidf", "log-tfidf", "bm25"}
+
+// Returns the scorer with the name. k1 and b only apply to bm25.
+func newScorer(name string, k1, b float64) (Scorer, error) {
+	switch name {
+	case "tfidf":
+		return rawTfIdfScorer{}, nil
+	case "log-tfidf":
+		return logTfIdfScorer{}, nil
+	case "bm25":
+		return bm25Scorer{k1: k1, b: b}, nil
+	}
+	return nil, queryError{"unknown scorer " + name + ", choose one of " + strings.Join(scorerNames, ", ")}
+}
+
+// The original ranking: term frequency times the inverse of the document
+// frequency, without damping. A term on one page of a hundred is weighted a
+// hundred times more than a term on every page.
+type rawTfIdfScorer struct{}
+
+func (rawTfIdfScorer) score(occurrences float64, docLength, docsWithTerm int, corpus Corpus) float64 {
+	return tfIdf(occurrences, docLength, docsWithTerm, corpus.documents)
+}
+
+// Term frequency times the logarithm of the inverse document frequency. One
+// is added inside the logarithm so a term on every page still counts.
+type logTfIdfScorer struct{}
+
+func (logTfIdfScorer) score(occurrences float64, docLength, docsWithTerm int, corpus Corpus) float64 {
+	if docLength == 0 || docsWithTerm == 0 {
+		return 0
+	}
+	tf := occurrences / float64(docLength)
+	return tf * math.Log(1+float64(corpus.documents)/float64(docsWithTerm))
+}
+
+// Okapi BM25. k1 sets how quickly more occurrences of a term stop adding to
+// the score, and b how much long pages are penalised compared to the average.
+type bm25Scorer struct {
+	k1, b float64
+}
+
+func (scorer bm25Scorer) score(occurrences float64, docLength, docsWithTerm int, corpus Corpus) float64 {
+	if occurrences == 0 || corpus.averageLength == 0 {
+		return 0
+	}
+	n := float64(docsWithTerm)
+	idf := math.Log(1 + (float64(corpus.documents)-n+0.5)/(n+0.5))
+	lengthNorm := 1 - scorer.b + scorer.b*float64(docLength)/corpus.averageLength
+	return idf * occurrences * (scorer.k1 + 1) / (occurrences + scorer.k1*lengthNorm)
+}
+
+// Returns the size of the index, for scoring.
+func (ebook *Index) corpus() (Corpus, error) {
+	documents, err := ebook.store.documentCount()
+	if err != nil {
+		return Corpus{}, err
+	}
+	terms, err := ebook.store.totalTerms()
+	if err != nil {
+		return Corpus{}, err
+	}
+	corpus := Corpus{documents: documents}
+	if documents > 0 {
+		corpus.averageLength = float64(terms) / float64(documents)
+	}
+	return corpus, nil
+}
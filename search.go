@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/kljensen/snowball"
@@ -15,31 +17,55 @@ type TemplateData struct {
 	Query        string
 	Data         []TfIdfValue
 	DatabaseName string
+	// The scorer asked for in the query, kept for the next search.
+	Scorer string
+	// The amount of results, the first one shown counting from 1, and the
+	// last one shown.
+	Total, First, Last int
+	// Links to the previous and next page of results, empty on the first and
+	// last page.
+	PrevURL, NextURL string
+	// A spelling correction of the query and a link to its results, and
+	// whether the results shown are for it, with a link to the results of
+	// the query as it was written.
+	Suggestion, SuggestionURL string
+	Corrected                 bool
+	OriginalURL               string
+	// What each wildcard of the query matched.
+	Expansions   []string
 	Error        bool
 	ErrorMessage template.HTML
 }
 
-func (ebook *Index) wildcardSearch(searchWord string) (allTfIdfValues TfIdfSlice) {
-	query := "SELECT id FROM words WHERE name LIKE ?"
-	rows, err := ebook.db.Query(query, searchWord+"%")
-	if err != nil {
-		log.Fatalf("Could not query during wildcard search %v", err)
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var wordID int
-		err := rows.Scan(&wordID)
-		if err == nil {
-			word := ebook.getWord(wordID)
-			fmt.Println("Current word:" + word)
-			tfIdfValues := ebook.sortTfIdf(word)
-			allTfIdfValues = append(allTfIdfValues, tfIdfValues...)
-		}
+// How a search is run and which of its results are returned.
+type SearchOptions struct {
+	wildcard bool
+	scorer   Scorer
+	// The amount of results to skip, and the most to return. A limit of 0
+	// returns every result.
+	offset, limit int
+}
+
+// Returns how many of the best results must be ranked to return the ones the
+// options ask for, or 0 when every result is returned.
+func (options SearchOptions) keep() int {
+	if options.limit <= 0 {
+		return 0
 	}
+	return options.offset + options.limit
+}
 
-	sort.Sort(allTfIdfValues)
-	return allTfIdfValues
+// Returns the results the options ask for from all the results up to keep,
+// which must be sorted.
+func (options SearchOptions) page(results TfIdfSlice) TfIdfSlice {
+	if options.offset >= len(results) {
+		return nil
+	}
+	results = results[options.offset:]
+	if options.limit > 0 && len(results) > options.limit {
+		results = results[:options.limit]
+	}
+	return results
 }
 
 func isBigram(query string) bool {
@@ -52,109 +78,324 @@ func splitBigram(query string) (word1 string, word2 string) {
 	return words[0], words[1]
 }
 
-// For searching bigram wildcards - example: computer scien% gives computer science and computer scientist.
-func (ebook *Index) bigramWildcardSearch(word1, word2 string) (displayTfIdfValues TfIdfSlice) {
-	var similarWordIDs []int
-	var allTfIdfValues TfIdfSlice
-	query := "SELECT id FROM words WHERE name LIKE ?"
-	rows, err := ebook.db.Query(query, word2+"%")
+// For searching bigram wildcards - example: computer scien gives computer
+// science and computer scientist. The second word is matched as it is
+// written, so it is not stemmed first. A url with several of the bigrams is
+// ranked once, by the sum of their scores.
+func (ebook *Index) bigramWildcardSearch(word1, word2 string, options SearchOptions) (searchResults, error) {
+	expansion, err := ebook.expandPattern(word2 + "*")
 	if err != nil {
-		log.Fatalf("Could not query during wildcard search %v", err)
+		return searchResults{}, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var wordID int
-		err := rows.Scan(&wordID)
-		if err == nil {
-			similarWordIDs = append(similarWordIDs, wordID)
+	urls := make(map[int]struct{})
+	var parts []queryPart
+	for _, term := range expansion.terms {
+		part := queryPart{terms: []string{word1, term}}
+		if part.matches, err = ebook.matchPhrase(phrase{terms: part.terms, offsets: []int{0, 1}}); err != nil {
+			return searchResults{}, err
 		}
-	}
-	word1ID := ebook.findID("words", word1)
-	bigramWildcardQuery := "SELECT occurrences FROM bigrams WHERE word1_id=? AND word2_id=?"
-	for _, word2IDs := range similarWordIDs {
-		word2 := ebook.getWord(word2IDs)
-		fmt.Println(word2)
-		similarWordOccurrences, err := ebook.db.Query(bigramWildcardQuery, word1ID, word2IDs)
-		if err == nil {
-			allTfIdfValues = append(allTfIdfValues, ebook.sortBigramTfIdf(word1, word2)...)
+		if len(part.matches) == 0 {
+			continue
+		}
+		if part.anchors, err = ebook.anchorCounts(part.terms, true); err != nil {
+			return searchResults{}, err
 		}
-		defer similarWordOccurrences.Close()
+		for urlID := range part.matches {
+			urls[urlID] = struct{}{}
+		}
+		parts = append(parts, part)
 	}
-	sort.Sort(allTfIdfValues)
-	return allTfIdfValues
+	found, err := ranked(ebook.rankURLs(urls, parts, options))
+	found.expansions = []Expansion{expansion}
+	return found, err
 }
 
-func (ebook *Index) searchHandlerDatabase(w http.ResponseWriter, r *http.Request) {
-	t, err := template.ParseFiles("static/template.html")
-	if err != nil {
-		log.Fatalf("Could not parse template files %v", err)
-	}
-	var tfIdfValues []TfIdfValue
+// Runs the query and returns the page of its results the options ask for,
+// sorted by the scorer, along with the amount of results on every page.
+// Queries that use the query language or wildcards, or have more than two
+// words, are searched by booleanSearch, two word queries are searched as
+// bigrams. The wildcard option adds a * to the last word of queries that
+// are only words, including the second word of bigrams. Returns ErrParse
+// for an empty query.
+func (ebook *Index) search(query string, options SearchOptions) (searchResults, error) {
+	found, err := ebook.rankQuery(query, options)
+	found.results = options.page(found.results)
+	return found, err
+}
+
+// Returns the results and total of a search without patterns.
+func ranked(results TfIdfSlice, total int, err error) (searchResults, error) {
+	return searchResults{results: results, total: total}, err
+}
 
-	// localhost:8080/search?term=query
-	query := r.URL.Query().Get("term")
-	wildcard := r.URL.Query().Get("wildcard")
+// Returns the best results for the query up to the ones the options ask for,
+// and the amount of results.
+func (ebook *Index) rankQuery(query string, options SearchOptions) (searchResults, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return searchResults{}, queryError{"the search is empty"}
+	}
+	// Bigrams add the * to their second word themselves.
+	if words := strings.Fields(query); options.wildcard && len(words) != 2 && isBagOfWords(query) && !isPattern(words[len(words)-1]) {
+		query += "*"
+	}
 
+	if isBooleanQuery(query) {
+		return ebook.booleanSearch(query, options)
+	}
 	if isBigram(query) {
 		word1, word2 := splitBigram(query)
 		stemmedWord1, stemmedWord2 := ebook.validateAndStemBigram(word1, word2)
-		if wildcard != "" {
-			tfIdfValues = ebook.bigramWildcardSearch(stemmedWord1, stemmedWord2)
-		} else {
-			tfIdfValues = ebook.sortBigramTfIdf(stemmedWord1, stemmedWord2)
+		if stemmedWord1 == "" {
+			// With a stopword there is no bigram, so the words are searched as
+			// a bag, which leaves the stopword out.
+			if options.wildcard {
+				query += "*"
+			}
+			return ebook.booleanSearch(query, options)
 		}
+		if options.wildcard {
+			return ebook.bigramWildcardSearch(stemmedWord1, strings.ToLower(word2), options)
+		}
+		return ranked(ebook.sortBigramTfIdf(stemmedWord1, stemmedWord2, options))
+	}
 
-		if len(tfIdfValues) != 0 {
-			err = t.Execute(w, TemplateData{
-				DatabaseName: ebook.databaseName,
-				Query:        query,
-				Data:         tfIdfValues,
-			})
-			if err != nil {
-				log.Fatalf("Execute: %v", err)
-			}
-		} else {
-			err = t.Execute(w, TemplateData{
-				DatabaseName: ebook.databaseName,
-				Error:        true,
-				ErrorMessage: template.HTML("Word: " + "<strong>" + query + "</strong>" + " not found."),
-			})
-			if err != nil {
-				log.Fatalf("Execute: %v", err)
-			}
+	stemmedQuery, err := snowball.Stem(query, "english", true)
+	if err != nil {
+		return searchResults{}, fmt.Errorf("could not stem %q: %w: %v", query, ErrParse, err)
+	}
+	return ranked(ebook.sortTfIdf(stemmedQuery, options))
+}
+
+// Returns the scorer with the name, or the scorer of the server when the name
+// is empty.
+func (ebook *Index) queryScorer(name string) (Scorer, error) {
+	if name == "" {
+		return ebook.scorer, nil
+	}
+	return newScorer(name, ebook.config.bm25K1, ebook.config.bm25B)
+}
+
+// The parameters of a search made over HTTP, shared by the results page and
+// the API.
+type searchRequest struct {
+	query    string
+	wildcard bool
+	// The name of the scorer, or empty for the scorer of the server.
+	scorer string
+	// The amount of results to skip, and the most to return.
+	offset, limit int
+	// Whether to search the query as it is written, even when the server
+	// corrects the spelling of queries without results.
+	exact bool
+}
+
+// Read the search from the query string, as in
+// /search?term=query&wildcard=on&scorer=bm25&limit=10&page=2. The results
+// to show are given by offset, or by a page counting from 1, and limit,
+// which defaults to the page size of the server. Returns ErrParse when they
+// are not numbers in range.
+func (ebook *Index) parseSearchRequest(r *http.Request) (searchRequest, error) {
+	params := r.URL.Query()
+	request := searchRequest{
+		query:    params.Get("term"),
+		wildcard: params.Get("wildcard") != "",
+		scorer:   params.Get("scorer"),
+		limit:    ebook.config.pageSize,
+		exact:    params.Get("exact") != "",
+	}
+
+	var err error
+	if text := params.Get("limit"); text != "" {
+		request.limit, err = strconv.Atoi(text)
+		if err != nil || request.limit < 1 || request.limit > ebook.config.maxLimit {
+			return request, queryError{"limit must be a number from 1 to " + strconv.Itoa(ebook.config.maxLimit)}
 		}
-	} else {
-		if stemmedQuery, err := snowball.Stem(query, "english", true); err == nil {
-			if wildcard != "" {
-				tfIdfValues = ebook.wildcardSearch(stemmedQuery)
-			} else {
-				tfIdfValues = ebook.sortTfIdf(stemmedQuery)
-			}
+	}
+	offset, page := params.Get("offset"), params.Get("page")
+	if offset != "" && page != "" {
+		return request, queryError{"give either an offset or a page, not both"}
+	}
+	if offset != "" {
+		request.offset, err = strconv.Atoi(offset)
+		if err != nil || request.offset < 0 {
+			return request, queryError{"offset must be a number of at least 0"}
+		}
+	}
+	if page != "" {
+		number, err := strconv.Atoi(page)
+		if err != nil || number < 1 {
+			return request, queryError{"page must be a number of at least 1"}
+		}
+		request.offset = (number - 1) * request.limit
+	}
+	return request, nil
+}
 
-			if err == nil && len(tfIdfValues) != 0 {
-				err = t.Execute(w, TemplateData{
-					DatabaseName: ebook.databaseName,
-					Query:        query,
-					Data:         tfIdfValues,
-				})
-				if err != nil {
-					log.Fatalf("Execute: %v", err)
-				}
-			} else {
-				err = t.Execute(w, TemplateData{
-					DatabaseName: ebook.databaseName,
-					Error:        true,
-					ErrorMessage: template.HTML("Word: " + "<strong>" + query + "</strong>" + " not found."),
-				})
-				if err != nil {
-					log.Fatalf("Execute: %v", err)
-				}
-			}
+// Returns the link to the results of the request starting at offset.
+func (request searchRequest) pageURL(path string, offset int) string {
+	params := url.Values{}
+	params.Set("term", request.query)
+	if request.wildcard {
+		params.Set("wildcard", "on")
+	}
+	if request.scorer != "" {
+		params.Set("scorer", request.scorer)
+	}
+	if request.exact {
+		params.Set("exact", "on")
+	}
+	params.Set("limit", strconv.Itoa(request.limit))
+	if offset > 0 {
+		params.Set("offset", strconv.Itoa(offset))
+	}
+	return path + "?" + params.Encode()
+}
+
+// The page of results of a search, along with what its patterns matched
+// and a spelling correction of its query.
+type searchResults struct {
+	results TfIdfSlice
+	// The amount of results on every page.
+	total      int
+	expansions []Expansion
+	// The query with the words that are not in the index corrected, or empty
+	// when every word is in the index.
+	suggestion string
+	// Whether the results are for the suggestion, as the query had none.
+	corrected bool
+}
 
-		} else {
-			log.Fatalf("Error in word stemming %v", err)
+// Runs the query like search, and suggests a correction when it has words
+// that are not in the index, unless it is a wildcard search. With
+// autocorrect, a query without results is searched as its correction
+// instead.
+func (ebook *Index) correctedSearch(query string, options SearchOptions, autocorrect bool) (searchResults, error) {
+	found, err := ebook.search(query, options)
+	// The last word of a wildcard search is only the start of a word.
+	if err != nil || options.wildcard {
+		return found, err
+	}
+	if found.suggestion, err = ebook.suggestQuery(query); err != nil || found.suggestion == "" {
+		return found, err
+	}
+	if autocorrect && found.total == 0 {
+		correction, err := ebook.search(found.suggestion, options)
+		if err != nil {
+			return found, err
+		}
+		if correction.total > 0 {
+			correction.suggestion, correction.corrected = found.suggestion, true
+			found = correction
 		}
 	}
+	return found, nil
+}
+
+// Runs the search, returning the page of results it asks for. Returns
+// ErrParse when the query or the scorer are not understood.
+func (ebook *Index) runSearchRequest(request searchRequest) (searchResults, error) {
+	scorer, err := ebook.queryScorer(request.scorer)
+	if err != nil {
+		return searchResults{}, err
+	}
+	options := SearchOptions{
+		wildcard: request.wildcard,
+		scorer:   scorer,
+		offset:   request.offset,
+		limit:    request.limit,
+	}
+	return ebook.correctedSearch(request.query, options, ebook.config.autocorrect && !request.exact)
+}
 
+// Returns what is wrong with a search that returned ErrParse, for the user.
+func parseErrorMessage(err error) string {
+	var malformed queryError
+	if errors.As(err, &malformed) {
+		return malformed.message
+	}
+	return "the search could not be understood"
+}
+
+func (ebook *Index) searchHandlerDatabase(w http.ResponseWriter, r *http.Request) {
+	t, err := template.ParseFiles("static/template.html")
+	if err != nil {
+		fmt.Println("Could not parse template files:", err)
+		http.Error(w, "Could not load the results page.", http.StatusInternalServerError)
+		return
+	}
+
+	request, err := ebook.parseSearchRequest(r)
+	query := request.query
+	data := TemplateData{
+		DatabaseName: ebook.databaseName,
+		Query:        query,
+		Scorer:       request.scorer,
+	}
+	status := http.StatusOK
+	var found searchResults
+	if err == nil {
+		found, err = ebook.runSearchRequest(request)
+	}
+	tfIdfValues, total := found.results, found.total
+	for _, expansion := range found.expansions {
+		data.Expansions = append(data.Expansions, "Wildcard "+expansion.message()+".")
+	}
+	if found.suggestion != "" {
+		corrected := request
+		corrected.query, corrected.offset = found.suggestion, 0
+		data.Suggestion = found.suggestion
+		data.SuggestionURL = corrected.pageURL(r.URL.Path, 0)
+	}
+	if found.corrected {
+		original := request
+		original.exact, original.offset = true, 0
+		data.Corrected = true
+		data.OriginalURL = original.pageURL(r.URL.Path, 0)
+		// Later pages are of the correction.
+		request.query = found.suggestion
+	}
+	if errors.Is(err, ErrParse) {
+		status = http.StatusBadRequest
+		data.Error = true
+		data.ErrorMessage = template.HTML("Could not understand the search " + "<strong>" + template.HTMLEscapeString(query) + "</strong>: " + template.HTMLEscapeString(parseErrorMessage(err)) + ".")
+	} else if err != nil {
+		fmt.Println("Search for", query, "failed:", err)
+		http.Error(w, "The search could not be completed.", http.StatusInternalServerError)
+		return
+	} else if total == 0 {
+		data.Error = true
+		data.ErrorMessage = template.HTML("Word: " + "<strong>" + template.HTMLEscapeString(query) + "</strong>" + " not found.")
+		for _, expansion := range data.Expansions {
+			data.ErrorMessage += template.HTML(" " + template.HTMLEscapeString(expansion))
+		}
+		if data.Suggestion != "" {
+			data.ErrorMessage += template.HTML(" Did you mean <a href=\"" + template.HTMLEscapeString(data.SuggestionURL) + "\">" + template.HTMLEscapeString(data.Suggestion) + "</a>?")
+		}
+	} else if len(tfIdfValues) == 0 {
+		data.Error = true
+		data.ErrorMessage = template.HTML("There are only " + strconv.Itoa(total) + " results for " + "<strong>" + template.HTMLEscapeString(query) + "</strong>" + ". <a href=\"" + template.HTMLEscapeString(request.pageURL(r.URL.Path, 0)) + "\">Back to the first page</a>.")
+	} else {
+		data.Data = tfIdfValues
+		data.Total = total
+		data.First = request.offset + 1
+		data.Last = request.offset + len(tfIdfValues)
+		if request.offset > 0 {
+			data.PrevURL = request.pageURL(r.URL.Path, max(request.offset-request.limit, 0))
+		}
+		if data.Last < total {
+			data.NextURL = request.pageURL(r.URL.Path, data.Last)
+		}
+	}
+
+	// Render into a buffer so that a failed template can still be reported.
+	var page bytes.Buffer
+	if err := t.Execute(&page, data); err != nil {
+		fmt.Println("Could not render results page:", err)
+		http.Error(w, "Could not render the results page.", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	page.WriteTo(w)
 }
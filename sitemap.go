@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Urlset is a sitemap that lists pages.
+type Urlset struct {
+	Urls []SitemapURL `xml:"url"`
+}
+
+type SitemapURL struct {
+	Loc        string `xml:"loc"`
+	Lastmod    string `xml:"lastmod"`
+	Changefreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// SitemapIndex is a sitemap that lists other sitemaps.
+type SitemapIndex struct {
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// Sitemap indexes are only followed this many levels deep.
+const maxSitemapDepth = 3
+
+// How long a page is trusted to stay the same for each changefreq value.
+// Pages marked "never" are never crawled again.
+var changeIntervals = map[string]time.Duration{
+	"always":  0,
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// Queue every page listed in the sitemap, following sitemap indexes.
+// Sitemaps that cannot be downloaded are recorded as skipped and those that
+// cannot be read are left out, so only storage errors are returned.
+func (ebook *Index) downloadSitemap(sitemap string) error {
+	return ebook.readSitemap(sitemap, 0, make(map[string]struct{}))
+}
+
+func (ebook *Index) readSitemap(sitemap string, depth int, seen map[string]struct{}) error {
+	if _, exists := seen[sitemap]; exists || depth > maxSitemapDepth {
+		return nil
+	}
+	seen[sitemap] = struct{}{}
+
+	// Sitemaps are fetched as politely as pages, and any type is read.
+	dl := ebook.fetcher.fetchPolitely(frontierItem{url: sitemap}, nil)
+	if dl.err != nil {
+		return ebook.abandon(sitemap, dl.err)
+	}
+	body, err := gunzip(dl.body)
+	if err != nil {
+		fmt.Println("Could not read sitemap", sitemap+":", err)
+		return nil
+	}
+
+	// Plain text sitemaps list one url per line.
+	body = bytes.TrimSpace(body)
+	if !bytes.HasPrefix(body, []byte("<")) {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				if err := ebook.addSitemapURL(SitemapURL{Loc: line}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	switch xmlRoot(body) {
+	case "sitemapindex":
+		var index SitemapIndex
+		if err := xml.Unmarshal(body, &index); err != nil {
+			fmt.Println("Could not unmarshal sitemap index", sitemap+":", err)
+			return nil
+		}
+		for _, child := range index.Sitemaps {
+			if err := ebook.readSitemap(strings.TrimSpace(child.Loc), depth+1, seen); err != nil {
+				return err
+			}
+		}
+	case "urlset":
+		var urlset Urlset
+		if err := xml.Unmarshal(body, &urlset); err != nil {
+			fmt.Println("Could not unmarshal sitemap", sitemap+":", err)
+			return nil
+		}
+		for _, entry := range urlset.Urls {
+			if err := ebook.addSitemapURL(entry); err != nil {
+				return err
+			}
+		}
+	default:
+		fmt.Println("Unknown sitemap format:", sitemap)
+	}
+	return nil
+}
+
+// Store the sitemap entry and queue its page by priority.
+func (ebook *Index) addSitemapURL(entry SitemapURL) error {
+	loc, err := clean(nil, entry.Loc, ebook.config.stripTracking)
+	if err != nil {
+		return nil
+	}
+	entry.Loc = loc
+	entry.Changefreq = strings.ToLower(strings.TrimSpace(entry.Changefreq))
+
+	priority := defaultPriority
+	if value, err := strconv.ParseFloat(strings.TrimSpace(entry.Priority), 64); err == nil && value >= 0 && value <= 1 {
+		priority = value
+	}
+	var lastmod string
+	if modified, ok := parseLastmod(entry.Lastmod); ok {
+		lastmod = modified.UTC().Format(time.RFC3339)
+	}
+
+	if err := ebook.store.addSchedule(entry.Loc, lastmod, entry.Changefreq, priority); err != nil {
+		return err
+	}
+	ebook.frontier.push(entry.Loc, 0, priority)
+	return nil
+}
+
+// Reports whether a page that was indexed before should be indexed again,
+// because its sitemap says it was modified since or its change frequency says
+// it is time to look again.
+func (ebook *Index) dueForRecrawl(url string) (bool, error) {
+	lastmod, changefreq, crawledAt, err := ebook.store.getSchedule(url)
+	if err != nil {
+		return false, err
+	}
+	crawled, err := time.Parse(time.RFC3339, crawledAt)
+	if err != nil {
+		return false, nil
+	}
+	if modified, ok := parseLastmod(lastmod); ok && modified.After(crawled) {
+		return true, nil
+	}
+	if interval, ok := changeIntervals[changefreq]; ok && time.Since(crawled) >= interval {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Returns the name of the root element of an XML document.
+func xmlRoot(body []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local
+		}
+	}
+}
+
+// Decompress the body if it is gzipped, whatever the file is named.
+func gunzip(body []byte) ([]byte, error) {
+	if len(body) < 2 || body[0] != 0x1f || body[1] != 0x8b {
+		return body, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Parse a W3C datetime, which may be just a date or a full timestamp.
+func parseLastmod(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00", "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
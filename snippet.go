@@ -0,0 +1,103 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+
+	"github.com/kljensen/snowball"
+)
+
+// Snippets shorter than this (usually only one word) get the sentences
+// after them added.
+const minSnippetLength = 100
+
+// Returns the snippet of the url that starts at the sentence.
+func (ebook *Index) getSnippet(urlID, sentenceID int) (string, error) {
+	return ebook.store.snippet(urlID, sentenceID, minSnippetLength)
+}
+
+// Returns the id of the sentence of the url that holds the most of the
+// terms, given the positions of each term. Ties go to the earliest sentence.
+// Returns 0 when none of the terms occur in the url.
+func bestSentence(urlID int, termPositions []map[int][]Position) int {
+	// The amount of different terms in each sentence.
+	counts := make(map[int]int)
+	for _, positions := range termPositions {
+		seen := make(map[int]struct{})
+		for _, position := range positions[urlID] {
+			if _, exists := seen[position.sentence]; !exists {
+				seen[position.sentence] = struct{}{}
+				counts[position.sentence]++
+			}
+		}
+	}
+
+	best, bestCount := 0, 0
+	for sentence, count := range counts {
+		if count > bestCount || (count == bestCount && sentence < best) {
+			best, bestCount = sentence, count
+		}
+	}
+	return best
+}
+
+// A Highlight is a word of a snippet that matches the query, from the
+// character at Start up to the one at End. Characters are Unicode code
+// points.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Returns every word of the text that stems to one of the terms. Matching by
+// stem also finds the words in other forms and cases, such as "Pricing" for
+// the term "price".
+func highlights(text string, terms []string) []Highlight {
+	wanted := make(map[string]struct{}, len(terms))
+	for _, term := range terms {
+		wanted[term] = struct{}{}
+	}
+
+	var found []Highlight
+	checkWord := func(word string, start, end int) {
+		stemmedWord, err := snowball.Stem(word, "english", true)
+		if _, exists := wanted[stemmedWord]; exists && err == nil {
+			found = append(found, Highlight{Start: start, End: end})
+		}
+	}
+
+	// The byte and character offsets of the start of the current word, or
+	// -1 between words.
+	startByte, startChar := -1, -1
+	char := 0
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			if startByte < 0 {
+				startByte, startChar = i, char
+			}
+		} else if startByte >= 0 {
+			checkWord(text[startByte:i], startChar, char)
+			startByte = -1
+		}
+		char++
+	}
+	if startByte >= 0 {
+		checkWord(text[startByte:], startChar, char)
+	}
+	return found
+}
+
+// Escape the text for HTML and put the highlighted words in bold.
+func highlightHTML(text string, highlighted []Highlight) template.HTML {
+	var html strings.Builder
+	runes := []rune(text)
+	last := 0
+	for _, h := range highlighted {
+		html.WriteString(template.HTMLEscapeString(string(runes[last:h.Start])))
+		html.WriteString("<strong>" + template.HTMLEscapeString(string(runes[h.Start:h.End])) + "</strong>")
+		last = h.End
+	}
+	html.WriteString(template.HTMLEscapeString(string(runes[last:])))
+	return template.HTML(html.String())
+}
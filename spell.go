@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/kljensen/snowball"
+)
+
+// Suggests corrections for misspelled terms from the terms in the index.
+type speller struct {
+	// The amount of urls each term occurs in.
+	documents map[string]int
+	// The terms by their length in runes, so a term is only compared with
+	// terms of a similar length.
+	byLength map[int][]string
+	// The way each term is most often written, to show corrections as words
+	// rather than stems.
+	written map[string]string
+}
+
+func newSpeller(vocabulary map[string]int, written map[string]string) *speller {
+	s := &speller{documents: vocabulary, byLength: make(map[int][]string), written: written}
+	for term := range vocabulary {
+		length := len([]rune(term))
+		s.byLength[length] = append(s.byLength[length], term)
+	}
+	return s
+}
+
+// Returns the speller for the terms in the index, reading them the first
+// time it is needed. Restart the server after a crawl to suggest new terms.
+func (ebook *Index) speller() (*speller, error) {
+	ebook.spellerMu.Lock()
+	defer ebook.spellerMu.Unlock()
+
+	if ebook.spellerCache == nil {
+		vocabulary, err := ebook.store.vocabulary()
+		if err != nil {
+			return nil, err
+		}
+		written, err := ebook.store.commonSurfaceForms()
+		if err != nil {
+			return nil, err
+		}
+		ebook.spellerCache = newSpeller(vocabulary, written)
+	}
+	return ebook.spellerCache, nil
+}
+
+// The most edits a correction may be from a term. Short terms allow fewer
+// edits, as almost any short term is a couple of edits from another.
+func maxEdits(length int) int {
+	switch {
+	case length < 3:
+		return 0
+	case length <= 4:
+		return 1
+	}
+	return 2
+}
+
+// Returns the term in the index closest to the term, counting insertions,
+// deletions, substitutions and swaps of adjacent letters as one edit. Of the
+// terms as close, the one in the most urls wins. Reports false when no term
+// is close enough.
+func (s *speller) correct(term string) (string, bool) {
+	length := len([]rune(term))
+	limit := maxEdits(length)
+	best, bestEdits, bestDocuments := "", limit+1, 0
+	for candidateLength := length - limit; candidateLength <= length+limit; candidateLength++ {
+		for _, candidate := range s.byLength[candidateLength] {
+			edits := editDistance(term, candidate, limit)
+			if edits > limit || edits == 0 {
+				continue
+			}
+			documents := s.documents[candidate]
+			if edits < bestEdits || edits == bestEdits && (documents > bestDocuments || documents == bestDocuments && candidate < best) {
+				best, bestEdits, bestDocuments = candidate, edits, documents
+			}
+		}
+	}
+	return best, best != ""
+}
+
+// Returns the edit distance between a and b, counting a swap of adjacent
+// letters as one edit, or limit+1 once it is more than limit.
+func editDistance(a, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	if abs(len(s)-len(t)) > limit {
+		return limit + 1
+	}
+	// Three rows of the distance matrix: two rows back, the last row and
+	// the current row.
+	before := make([]int, len(t)+1)
+	last := make([]int, len(t)+1)
+	row := make([]int, len(t)+1)
+	for j := range last {
+		last[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		row[0] = i
+		smallest := row[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			row[j] = min(last[j]+1, row[j-1]+1, last[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				row[j] = min(row[j], before[j-2]+1)
+			}
+			smallest = min(smallest, row[j])
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+		before, last, row = last, row, before
+	}
+	return min(last[len(t)], limit+1)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// Returns the query with every word that is not in the index replaced by its
+// correction, as it is most often written, or an empty string when there is
+// nothing to correct. Operators, patterns and stopwords are left as they
+// are, as are the quotes, parentheses and minus signs around words.
+func (ebook *Index) suggestQuery(query string) (string, error) {
+	s, err := ebook.speller()
+	if err != nil {
+		return "", err
+	}
+
+	words := strings.Fields(query)
+	corrected := false
+	for i, word := range words {
+		if word == "AND" || word == "OR" || word == "NOT" {
+			continue
+		}
+		core := strings.TrimLeft(word, `"(-`)
+		before := word[:len(word)-len(core)]
+		core = strings.TrimRight(core, `")`)
+		after := word[len(before)+len(core):]
+		if core == "" || isPattern(core) {
+			continue
+		}
+		stemmedWord, err := snowball.Stem(core, "english", true)
+		if err != nil {
+			continue
+		}
+		if _, exists := StopWords[stemmedWord]; exists {
+			continue
+		}
+		if _, exists := s.documents[stemmedWord]; exists {
+			continue
+		}
+		if correction, ok := s.correct(stemmedWord); ok {
+			if form, exists := s.written[correction]; exists {
+				correction = form
+			}
+			words[i] = before + correction + after
+			corrected = true
+		}
+	}
+	if !corrected {
+		return "", nil
+	}
+	return strings.Join(words, " "), nil
+}
@@ -0,0 +1,115 @@
+// Completes the last word of the search bar from /api/suggest as it is typed.
+(function () {
+    var input = document.getElementById("inputBox");
+    if (!input) {
+        return;
+    }
+    input.setAttribute("autocomplete", "off");
+
+    var list = document.createElement("ul");
+    list.className = "suggestions";
+    list.hidden = true;
+    input.parentNode.insertBefore(list, input.nextSibling);
+
+    var selected = -1;
+    var timer = null;
+    var latest = 0;
+
+    // Splits the text into what comes before the words being completed and
+    // the words themselves: the last word, or the last word and a space so
+    // that bigrams starting with it are completed.
+    function split(text) {
+        var match = /(\S+\s+)?\S*$/.exec(text);
+        var tail = match[0];
+        if (!/\s$/.test(tail)) {
+            tail = /\S*$/.exec(text)[0];
+        }
+        return { head: text.slice(0, text.length - tail.length), tail: tail };
+    }
+
+    function close() {
+        list.hidden = true;
+        list.innerHTML = "";
+        selected = -1;
+    }
+
+    function choose(item) {
+        input.value = item.dataset.value;
+        close();
+        input.focus();
+    }
+
+    function show(head, suggestions) {
+        list.innerHTML = "";
+        selected = -1;
+        suggestions.forEach(function (suggestion) {
+            var item = document.createElement("li");
+            item.textContent = suggestion.text;
+            item.dataset.value = head + suggestion.text;
+            item.addEventListener("mousedown", function (event) {
+                event.preventDefault();
+                choose(item);
+            });
+            list.appendChild(item);
+        });
+        // Place the list under the input, which shares its positioned parent.
+        list.style.left = input.offsetLeft + "px";
+        list.style.top = input.offsetTop + input.offsetHeight + "px";
+        list.style.minWidth = input.offsetWidth + "px";
+        list.hidden = suggestions.length === 0;
+    }
+
+    function suggest() {
+        var parts = split(input.value);
+        // Operators, phrases and prefixes are left alone.
+        if (parts.tail.trim() === "" || /["()*?]|^-/.test(parts.tail) || /^(AND|OR|NOT)\s*$/.test(parts.tail)) {
+            close();
+            return;
+        }
+        var request = ++latest;
+        fetch("/api/suggest?prefix=" + encodeURIComponent(parts.tail))
+            .then(function (response) { return response.json(); })
+            .then(function (body) {
+                // A slower answer to an earlier prefix is dropped.
+                if (request === latest && body.suggestions) {
+                    show(parts.head, body.suggestions);
+                }
+            })
+            .catch(close);
+    }
+
+    function highlight(index) {
+        var items = list.children;
+        if (items.length === 0) {
+            return;
+        }
+        if (selected >= 0) {
+            items[selected].classList.remove("selected");
+        }
+        selected = (index + items.length) % items.length;
+        items[selected].classList.add("selected");
+    }
+
+    input.addEventListener("input", function () {
+        clearTimeout(timer);
+        timer = setTimeout(suggest, 150);
+    });
+    input.addEventListener("keydown", function (event) {
+        if (list.hidden) {
+            return;
+        }
+        if (event.key === "ArrowDown") {
+            event.preventDefault();
+            highlight(selected + 1);
+        } else if (event.key === "ArrowUp") {
+            event.preventDefault();
+            highlight(selected - 1);
+        } else if (event.key === "Enter" && selected >= 0) {
+            event.preventDefault();
+            choose(list.children[selected]);
+        } else if (event.key === "Escape") {
+            close();
+        }
+    });
+    input.addEventListener("blur", close);
+})();
@@ -0,0 +1,242 @@
+package main
+
+// A Store holds the index. The crawler adds urls, terms, sentences and
+// postings to it, and the ranker reads the postings and document stats back.
+// Terms are stored already stemmed. Lookups of urls, terms and sentences that
+// are not in the store return ErrNotFound, and everything else that goes
+// wrong returns ErrStorage.
+type Store interface {
+	// Returns the id of the url or term, adding it when it is new.
+	upsertURL(url string) (int, error)
+	upsertTerm(term string) (int, error)
+	findURL(url string) (int, error)
+	findTerm(term string) (int, error)
+
+	// Reports whether the url was indexed at the current indexVersion. Urls
+	// indexed at an older version report false, so they are indexed again.
+	isIndexed(urlID int) (bool, error)
+	// Replace everything indexed for the url of the page with the page, all
+	// at once, and record that it was indexed just now. This includes the
+	// text of the links on the page to other urls.
+	writePage(page *PageIndex) error
+
+	// Returns every url the term or bigram occurs in.
+	postings(termID int) ([]Posting, error)
+	bigramPostings(term1ID, term2ID int) ([]Posting, error)
+	// Returns every position of the term, by url id, in order.
+	positions(termID int) (map[int][]Position, error)
+	// Returns how often the term occurs in the text of links to each url,
+	// by url id. Urls that are linked to are added when the page with the
+	// links is written, and indexed once they are crawled.
+	anchorCounts(termID int) (map[int]int, error)
+	// Returns the stats of each of the urls, by url id, reading them in as
+	// few queries as it can.
+	docStats(urlIDs []int) (map[int]DocStats, error)
+	// Returns every link between urls.
+	links() ([]Link, error)
+	// Replace the authority of every url, by url id.
+	setAuthority(authority map[int]float64) error
+
+	// Returns the amount of urls with at least one term. It is kept up to
+	// date as pages are written rather than counted.
+	documentCount() (int, error)
+	// Returns the amount of terms in every url together, kept up to date
+	// like documentCount.
+	totalTerms() (int, error)
+	// Returns every term that occurs in a url, along with the amount of urls
+	// it occurs in.
+	vocabulary() (map[string]int, error)
+	// Returns every bigram that occurs in a url, along with the amount of
+	// urls it occurs in.
+	bigramVocabulary() (map[[2]string]int, error)
+	// Returns the words as written that match the pattern, where * stands
+	// for any characters and ? for one, on the most urls first. Returns at
+	// most limit words.
+	matchSurfaceForms(pattern string, limit int) ([]SurfaceForm, error)
+	// Returns the way each term is most often written, by term.
+	commonSurfaceForms() (map[string]string, error)
+	// Returns the sentence along with the sentences after it on the same url,
+	// until the snippet is at least minLength bytes long.
+	snippet(urlID, sentenceID, minLength int) (string, error)
+
+	// Record that the url was not crawled and why.
+	addSkipped(url, reason, detail string) error
+	// Store the sitemap metadata of the url.
+	addSchedule(url, lastmod, changefreq string, priority float64) error
+	// Returns the sitemap lastmod and changefreq of the url and when it was
+	// last indexed. Each is empty when it is not known.
+	getSchedule(url string) (lastmod, changefreq, crawledAt string, err error)
+
+	// Returns the amount of each kind of row in the store.
+	stats() ([]StoreStat, error)
+	close() error
+}
+
+// A PageIndex is everything indexed for one url, counted in memory so that
+// it can be written to the store at once.
+type PageIndex struct {
+	url, title string
+	// The sentences of the page in order, without duplicates.
+	sentences     []string
+	sentenceIndex map[string]int
+	// The stemmed terms and bigrams of the page.
+	terms   map[string]*TermCount
+	bigrams map[[2]string]*TermCount
+	// The occurrences of each stemmed term in the text of the links on the
+	// page, by the url they link to.
+	anchorTerms map[string]map[string]int
+	// The links on the page, as the url they link to and the text of the
+	// link.
+	links map[[2]string]struct{}
+	// The words of the page as they are written, lower cased, by the term
+	// each is stemmed to, with how often each occurs.
+	surfaceForms map[string]map[string]int
+}
+
+// Returns the amount of terms on the page, counting every occurrence.
+func (page *PageIndex) totalTerms() int {
+	total := 0
+	for _, count := range page.terms {
+		total += count.occurrences
+	}
+	return total
+}
+
+type TermCount struct {
+	occurrences int
+	// The index in sentences of the first sentence the term occurs in.
+	sentence int
+	// Every occurrence of the term, in order. Bigrams have none, since they
+	// can be found from the positions of their words.
+	positions []Position
+}
+
+// A Position is an occurrence of a term. Offsets count every token of the
+// page, stopwords included, so that the terms of a phrase are at consecutive
+// offsets. The sentence is the index in PageIndex.sentences until the page
+// is written, and the sentence id when read back from a store.
+type Position struct {
+	offset   int
+	sentence int
+	field    Field
+}
+
+func newPageIndex(url, title string) *PageIndex {
+	return &PageIndex{
+		url:           url,
+		title:         title,
+		sentenceIndex: make(map[string]int),
+		terms:         make(map[string]*TermCount),
+		bigrams:       make(map[[2]string]*TermCount),
+		anchorTerms:   make(map[string]map[string]int),
+		links:         make(map[[2]string]struct{}),
+		surfaceForms:  make(map[string]map[string]int),
+	}
+}
+
+// Add the sentence unless the page already has it, and return its index.
+func (page *PageIndex) addSentence(sentence string) int {
+	if i, exists := page.sentenceIndex[sentence]; exists {
+		return i
+	}
+	page.sentences = append(page.sentences, sentence)
+	page.sentenceIndex[sentence] = len(page.sentences) - 1
+	return len(page.sentences) - 1
+}
+
+// Count one more occurrence of the term, at the token offset in the
+// sentence.
+func (page *PageIndex) addTerm(term string, offset, sentence int, field Field) {
+	count, exists := page.terms[term]
+	if !exists {
+		count = &TermCount{sentence: sentence}
+		page.terms[term] = count
+	}
+	count.occurrences++
+	count.positions = append(count.positions, Position{offset: offset, sentence: sentence, field: field})
+}
+
+// Count one more occurrence of the word as it is written, which is stemmed
+// to the term.
+func (page *PageIndex) addSurfaceForm(form, term string) {
+	if page.surfaceForms[term] == nil {
+		page.surfaceForms[term] = make(map[string]int)
+	}
+	page.surfaceForms[term][form]++
+}
+
+// Add a link to the url with the text. Links with the same url and text are
+// only added once.
+func (page *PageIndex) addLink(url, text string) {
+	page.links[[2]string{url, text}] = struct{}{}
+}
+
+// Count one more occurrence of the term in the text of a link to the url.
+func (page *PageIndex) addAnchorTerm(url, term string) {
+	if page.anchorTerms[url] == nil {
+		page.anchorTerms[url] = make(map[string]int)
+	}
+	page.anchorTerms[url][term]++
+}
+
+// Count one more occurrence of the bigram in the sentence.
+func (page *PageIndex) addBigram(term1, term2 string, sentence int) {
+	key := [2]string{term1, term2}
+	if count, exists := page.bigrams[key]; exists {
+		count.occurrences++
+		return
+	}
+	page.bigrams[key] = &TermCount{occurrences: 1, sentence: sentence}
+}
+
+// A SurfaceForm is a word as it is written on pages, lower cased.
+type SurfaceForm struct {
+	form string
+	// The term the word is stemmed to.
+	term string
+	// The amount of urls the word occurs in.
+	documents int
+}
+
+// The version of what writePage stores for a url. Raise it whenever
+// writePage stores something new, so that urls indexed before are indexed
+// again when they are crawled.
+//
+//	1: links and the text of links, with the field of each position
+//	2: the words as they are written, for wildcards
+const indexVersion = 2
+
+// A Posting is a url that a term or bigram occurs in.
+type Posting struct {
+	urlID       int
+	occurrences int
+	// The first sentence the term occurs in.
+	sentenceID int
+}
+
+type DocStats struct {
+	url, title string
+	// The total amount of terms in the url.
+	totalTerms int
+	// The authority of the url, where the average url has 1. Urls that have
+	// none computed have 1 as well.
+	authority float64
+}
+
+// A Link is a link from one url to another.
+type Link struct {
+	fromID, toID int
+	from, to     string
+	anchorText   string
+}
+
+type StoreStat struct {
+	name  string
+	count int
+}
+
+// Both stores must satisfy Store.
+var (
+	_ Store = (*sqliteStore)(nil)
+	_ Store = (*memoryStore)(nil)
+)
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"testing"
+)
+
+// The pages every store is tested with.
+var testPages = []struct {
+	url, html string
+}{
+	{"https://example.com/fox", `<html><head><title>Foxes</title></head><body>
+		<p>The quick brown fox jumps over the lazy dog.</p>
+		<p>Foxes are clever.</p>
+		<a href="/dog">the lazy dog</a></body></html>`},
+	{"https://example.com/dog", `<html><head><title>Dogs</title></head><body>
+		<p>A lazy afternoon with a brown dog.</p></body></html>`},
+	{"https://example.com/quick", `<html><head><title>Speed</title></head><body>
+		<p>Quick quick quick cats chase mice.</p></body></html>`},
+}
+
+// Returns an index of the test pages in the store, written the way a crawl
+// writes them.
+func newTestIndex(t *testing.T, store Store) *Index {
+	t.Helper()
+	stopWords, err := createSWmap("stopwords-en.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	StopWords = stopWords
+
+	ebook := &Index{store: store, config: Config{sameHost: true, maxExpansions: 10}}
+	if ebook.scorer, err = newScorer("tfidf", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ebook.fieldWeights, err = parseFieldWeights(defaultFieldWeights); err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range testPages {
+		ex, err := parseHTML([]byte(page.html))
+		if err != nil {
+			t.Fatalf("could not parse %s: %v", page.url, err)
+		}
+		ex.item = frontierItem{url: page.url}
+		if err := store.writePage(ebook.countPage(ex)); err != nil {
+			t.Fatalf("could not write %s: %v", page.url, err)
+		}
+	}
+	return ebook
+}
+
+// Returns the urls of the results, best first.
+func resultURLs(results TfIdfSlice) []string {
+	urls := make([]string, 0, len(results))
+	for _, result := range results {
+		urls = append(urls, result.URL)
+	}
+	return urls
+}
+
+// Runs the test against a memory and a SQLite store.
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := openSQLiteStore(t.TempDir() + "/x.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.close()
+		test(t, store)
+	})
+}
+
+func TestStoreSearch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ebook := newTestIndex(t, store)
+		options := SearchOptions{scorer: ebook.scorer}
+
+		t.Run("sortTfIdf", func(t *testing.T) {
+			tests := []struct {
+				word  string
+				want  []string
+				total int
+			}{
+				// Fox and foxes are the same term.
+				{"foxes", []string{"https://example.com/fox"}, 1},
+				// The page that is mostly quick ranks first.
+				{"quick", []string{"https://example.com/quick", "https://example.com/fox"}, 2},
+				// The dog page is also linked to as the lazy dog.
+				{"dog", []string{"https://example.com/dog", "https://example.com/fox"}, 2},
+				{"missing", []string{}, 0},
+			}
+			for _, test := range tests {
+				results, total, err := ebook.sortTfIdf(test.word, options)
+				if err != nil {
+					t.Fatalf("sortTfIdf(%q) failed: %v", test.word, err)
+				}
+				if got := resultURLs(results); !slices.Equal(got, test.want) || total != test.total {
+					t.Errorf("sortTfIdf(%q) = %v of %d, want %v of %d", test.word, got, total, test.want, test.total)
+				}
+				if !sort.IsSorted(results) {
+					t.Errorf("sortTfIdf(%q) is not sorted by score", test.word)
+				}
+			}
+
+			// Only the best results are ranked, but every url is counted.
+			results, total, err := ebook.sortTfIdf("quick", SearchOptions{scorer: ebook.scorer, limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resultURLs(results); !slices.Equal(got, []string{"https://example.com/quick"}) || total != 2 {
+				t.Errorf("the best result for quick is %v of %d, want the quick page of 2", got, total)
+			}
+		})
+
+		t.Run("matchPhrase", func(t *testing.T) {
+			foxID, err := store.findURL("https://example.com/fox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dogID, err := store.findURL("https://example.com/dog")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Offsets count every word of the page from its title, stopwords
+			// included.
+			tests := []struct {
+				phrase string
+				want   map[int][]int
+			}{
+				{"brown fox", map[int][]int{foxID: {3}}},
+				{"jumps over the lazy", map[int][]int{foxID: {5}}},
+				// The text of the link is a sentence of the page as well.
+				{"lazy dog", map[int][]int{foxID: {8, 14}}},
+				// Phrases do not cross from the title into the body, from
+				// one sentence into the next or from the body into a link.
+				{"foxes the quick", map[int][]int{}},
+				{"dog foxes", map[int][]int{}},
+				{"clever the lazy", map[int][]int{}},
+				{"brown dog", map[int][]int{dogID: {6}}},
+				{"dog brown", map[int][]int{}},
+				{"the a", map[int][]int{}},
+			}
+			for _, test := range tests {
+				matches, err := ebook.matchPhrase(newPhrase(test.phrase))
+				if err != nil {
+					t.Fatalf("matchPhrase(%q) failed: %v", test.phrase, err)
+				}
+				if len(matches) != len(test.want) {
+					t.Errorf("matchPhrase(%q) = %v, want matches at %v", test.phrase, matches, test.want)
+					continue
+				}
+				for urlID, offsets := range test.want {
+					var got []int
+					for _, position := range matches[urlID] {
+						got = append(got, position.offset)
+					}
+					sort.Ints(got)
+					if !slices.Equal(got, offsets) {
+						t.Errorf("matchPhrase(%q) matched url %d at offsets %v, want %v", test.phrase, urlID, got, offsets)
+					}
+				}
+			}
+		})
+
+		t.Run("booleanSearch", func(t *testing.T) {
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"lazy AND NOT fox", []string{"https://example.com/dog"}},
+				{"fox OR mice", []string{"https://example.com/fox", "https://example.com/quick"}},
+				{`"brown dog"`, []string{"https://example.com/dog"}},
+				{`"foxes the quick"`, []string{}},
+				{"brown -dog", []string{}},
+				{"(quick OR afternoon) AND brown", []string{"https://example.com/dog", "https://example.com/fox"}},
+				{"cle*", []string{"https://example.com/fox"}},
+			}
+			for _, test := range tests {
+				found, err := ebook.booleanSearch(test.query, options)
+				if err != nil {
+					t.Fatalf("booleanSearch(%q) failed: %v", test.query, err)
+				}
+				got := resultURLs(found.results)
+				sort.Strings(got)
+				if !slices.Equal(got, test.want) || found.total != len(test.want) {
+					t.Errorf("booleanSearch(%q) = %v of %d, want %v", test.query, got, found.total, test.want)
+				}
+			}
+		})
+
+		t.Run("wildcard", func(t *testing.T) {
+			options := SearchOptions{scorer: ebook.scorer, wildcard: true}
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"cle", []string{"https://example.com/fox"}},
+				// The last word of a bag of words is only the start of a word.
+				{"cats chase cle", []string{"https://example.com/fox", "https://example.com/quick"}},
+				{"cats chase afternoo", []string{"https://example.com/dog", "https://example.com/quick"}},
+				// Queries using the query language are left as they are.
+				{"brown AND cle", []string{}},
+			}
+			for _, test := range tests {
+				found, err := ebook.search(test.query, options)
+				if err != nil {
+					t.Fatalf("search(%q) failed: %v", test.query, err)
+				}
+				got := resultURLs(found.results)
+				sort.Strings(got)
+				if !slices.Equal(got, test.want) {
+					t.Errorf("search(%q) with wildcard = %v, want %v", test.query, got, test.want)
+				}
+			}
+		})
+	})
+}
+
+func TestStoreDocumentCount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ebook := newTestIndex(t, store)
+
+		// A page of only stopwords has sentences but no terms, so it is not
+		// a document.
+		ex, err := parseHTML([]byte("<html><body><p>It is what it is.</p></body></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.item = frontierItem{url: "https://example.com/stopwords"}
+		if err := store.writePage(ebook.countPage(ex)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.findURL(ex.item.url); err != nil {
+			t.Fatalf("the page of stopwords was not written: %v", err)
+		}
+
+		if count, err := store.documentCount(); err != nil || count != len(testPages) {
+			t.Errorf("documentCount() = %d, %v, want %d", count, err, len(testPages))
+		}
+		// The words of the test pages that are not stopwords.
+		if total, err := store.totalTerms(); err != nil || total != 23 {
+			t.Errorf("totalTerms() = %d, %v, want 23", total, err)
+		}
+
+		// Rewriting a page with only stopwords takes its terms out of the
+		// totals.
+		quickID, err := store.findURL("https://example.com/quick")
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := store.docStats([]int{quickID, 0})
+		if err == nil {
+			t.Errorf("docStats of a missing url = %v, want an error", stats)
+		}
+		stats, err = store.docStats([]int{quickID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		quickTerms := stats[quickID].totalTerms
+		if stats[quickID].url != "https://example.com/quick" || quickTerms == 0 {
+			t.Errorf("docStats of the quick page = %+v", stats[quickID])
+		}
+		ex.item = frontierItem{url: "https://example.com/quick"}
+		if err := store.writePage(ebook.countPage(ex)); err != nil {
+			t.Fatal(err)
+		}
+		if count, err := store.documentCount(); err != nil || count != len(testPages)-1 {
+			t.Errorf("documentCount() after rewriting a page = %d, %v, want %d", count, err, len(testPages)-1)
+		}
+		if total, err := store.totalTerms(); err != nil || total != 23-quickTerms {
+			t.Errorf("totalTerms() after rewriting a page = %d, %v, want %d", total, err, 23-quickTerms)
+		}
+		if stats, err := store.docStats([]int{quickID}); err != nil || stats[quickID].totalTerms != 0 {
+			t.Errorf("docStats of the rewritten page = %+v, %v, want no terms", stats[quickID], err)
+		}
+	})
+}
@@ -2,20 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
-	"log"
 	"os"
 	"sort"
-	"strings"
 
 	"github.com/kljensen/snowball"
 )
 
 type TfIdfValue struct {
-	URL      string
-	Title    string
-	Sentence template.HTML
-	TfIdf    float64
+	URL   string
+	Title string
+	// The snippet with the highlighted words in bold.
+	Sentence   template.HTML
+	Snippet    string
+	Highlights []Highlight
+	TfIdf      float64
+}
+
+// Returns the result for the url, with the words of the snippet that match
+// the terms highlighted.
+func newResult(stats DocStats, score float64, snippet string, terms []string) TfIdfValue {
+	found := highlights(snippet, terms)
+	return TfIdfValue{
+		URL:        stats.url,
+		Title:      stats.title,
+		Sentence:   highlightHTML(snippet, found),
+		Snippet:    snippet,
+		Highlights: found,
+		TfIdf:      score,
+	}
 }
 
 type TfIdfSlice []TfIdfValue
@@ -24,226 +41,181 @@ func (s TfIdfSlice) Len() int           { return len(s) }
 func (s TfIdfSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s TfIdfSlice) Less(i, j int) bool { return s[i].TfIdf > s[j].TfIdf }
 
-func createSWmap(filepath string) map[string]struct{} {
+func createSWmap(filepath string) (map[string]struct{}, error) {
 	stopWordMap := make(map[string]struct{})
 	var stopWords []string
-	if data, err := os.ReadFile(filepath); err == nil {
-		if err = json.Unmarshal(data, &stopWords); err == nil {
-			for _, stopWord := range stopWords {
-				stopWordMap[stopWord] = struct{}{}
-			}
-		} else {
-			log.Fatalf("JSON could not be unmarshaled: %v", err)
-		}
-	} else {
-		log.Fatalf("File could not be read:  %v\n", err)
-	}
-	return stopWordMap
-}
-
-// Returns the amount of times that the word occurs in the given url.
-func (ebook *Index) getOccurrences(urlID, wordID int) int {
-	var occurrences int
-	err := ebook.queries.getFreq.QueryRow(urlID, wordID).Scan(&occurrences)
+	data, err := os.ReadFile(filepath)
 	if err != nil {
-		log.Fatalf("Could not find total occurrences %v", err)
+		return nil, fmt.Errorf("could not read stop words: %w", err)
 	}
-	return occurrences
-}
-
-// Returns the total amount of words in this url.
-func (ebook *Index) getTotalUrlWords(urlID int) int {
-	var occurrences int
-	err := ebook.queries.getTotalUrlWords.QueryRow(urlID).Scan(&occurrences)
-	if err != nil {
-		log.Fatalf("Could not count total words in doc %v", err)
-		return 0
+	if err = json.Unmarshal(data, &stopWords); err != nil {
+		return nil, fmt.Errorf("could not unmarshal stop words: %w: %v", ErrParse, err)
 	}
-	return occurrences
-}
-
-// Returns the total amount of docs with the given word.
-func (ebook *Index) getTotalDocsWithWord(wordID int) int {
-	var count int
-	err := ebook.queries.getTotalDocsWithWord.QueryRow(wordID).Scan(&count)
-	if err != nil {
-		log.Fatalf("Word could not be found in word table %v", err)
+	for _, stopWord := range stopWords {
+		stopWordMap[stopWord] = struct{}{}
 	}
-	return count
+	return stopWordMap, nil
 }
 
-// Returns the total amount of documents.
-func (ebook *Index) getDocumentCount() int {
-	var length int
-	err := ebook.queries.getDocCount.QueryRow().Scan(&length)
-	if err != nil {
-		log.Fatalf("Could not count document table %v", err)
-	}
-	return length
+// A part of a query, such as a word, a phrase or a prefix, and where it
+// matched.
+type queryPart struct {
+	// The stemmed terms of the part, bolded in snippets.
+	terms []string
+	// Where the part occurs, by url id.
+	matches map[int][]Position
+	// How often the part occurs in the text of links to each url, by url id.
+	anchors map[int]int
 }
 
-// Returns a slice of all of the url_ids that a word appears in.
-func (ebook *Index) getAllURLsForWord(wordID int) []int {
-	var urlIDs []int
-	rows, err := ebook.queries.getAllUrlsForWord.Query(wordID)
-	if err != nil {
-		log.Fatalf("Could not query when getting all urls of a word %v", err)
-		return nil
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var urlID int
-		err := rows.Scan(&urlID)
-		if err != nil {
-			log.Fatalf("Could not scan through all rows %v", err)
-		}
-		urlIDs = append(urlIDs, urlID)
+// Returns the occurrences of the part in the url, each counted by the weight
+// of its field. occurrences is used as body text when there are no positions
+// for the url.
+func (ebook *Index) weighPart(part queryPart, urlID, occurrences int) float64 {
+	weighted := float64(occurrences) * ebook.fieldWeights[bodyField]
+	if positions := part.matches[urlID]; len(positions) > 0 {
+		weighted = ebook.fieldWeights.weigh(positions)
 	}
-
-	return urlIDs
+	return weighted + float64(part.anchors[urlID])*ebook.fieldWeights[anchorField]
 }
 
-// Returns a slice of all of the url_ids that a bigram appears in.
-func (ebook *Index) getAllURLsForBigram(word1ID, word2ID int) []int {
-	var urls []int
-	rows, err := ebook.queries.getAllURLsForBigram.Query(word1ID, word2ID)
+// Rank the urls of the postings of the part with the scorer of the options,
+// blended with the authority of each url. Returns the best results the
+// options ask for, counting the ones they skip, along with the amount of
+// urls ranked. The terms of the part are bolded in the snippets, which start
+// at the sentence with the most matches, or at the first sentence of the
+// posting without any.
+func (ebook *Index) rankPostings(postings []Posting, part queryPart, options SearchOptions) (TfIdfSlice, int, error) {
+	corpus, err := ebook.corpus()
 	if err != nil {
-		log.Fatalf("Could not query when getting all urls of a bigram %v", err)
-		return nil
+		return nil, 0, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var urlID int
-		err := rows.Scan(&urlID)
-		if err != nil {
-			log.Fatalf("Could not scan through all rows %v", err)
-		}
-		urls = append(urls, urlID)
+	urlIDs := make([]int, len(postings))
+	for i, posting := range postings {
+		urlIDs[i] = posting.urlID
 	}
-
-	return urls
-}
-
-func (ebook *Index) getBigramOccurrences(word1ID, word2ID, urlID int) int {
-	var occurrences int
-	err := ebook.queries.getBigramsFreq.QueryRow(urlID, word1ID, word2ID).Scan(&occurrences)
+	docStats, err := ebook.store.docStats(urlIDs)
 	if err != nil {
-		log.Fatalf("Could not find total occurrences %v", err)
+		return nil, 0, err
 	}
-	return occurrences
-}
 
-func (ebook *Index) getTotalDocsWithBigram(word1ID, word2ID int) int {
-	var count int
-	err := ebook.queries.getTotalDocsForBigram.QueryRow(word1ID, word2ID).Scan(&count)
-	if err != nil {
-		log.Fatalf("Word could not be found in word table %v", err)
+	top := newTopK(options.keep())
+	for _, posting := range postings {
+		stats := docStats[posting.urlID]
+		occurrences := ebook.weighPart(part, posting.urlID, posting.occurrences)
+		score := options.scorer.score(occurrences, stats.totalTerms, len(postings), corpus)
+		score = blendAuthority(score, stats.authority, ebook.config.authorityWeight)
+		top.add(scoredURL{urlID: posting.urlID, stats: stats, score: score, sentenceID: posting.sentenceID})
 	}
-	return count
+	return ebook.snippetResults(top, part.terms, []map[int][]Position{part.matches})
 }
 
-// Given a url_id, returns the url in string form.
-func (ebook *Index) getURL(urlID int) string {
-	var url string
-	err := ebook.queries.getURL.QueryRow(urlID).Scan(&url)
+// Rank the urls that matched a query by the sum of the scores of each of its
+// parts that occurs in them, blended with the authority of each url. Returns
+// the best results the options ask for, counting the ones they skip, along
+// with the amount of urls ranked. The terms of the parts are bolded in the
+// snippets, which start at the sentence with the most matches.
+func (ebook *Index) rankURLs(urls map[int]struct{}, parts []queryPart, options SearchOptions) (TfIdfSlice, int, error) {
+	corpus, err := ebook.corpus()
 	if err != nil {
-		log.Fatalf("Could not find url %v", err)
+		return nil, 0, err
 	}
-	return url
-}
-
-// Given a url_id, returns the title in string form.
-func (ebook *Index) getTitle(urlID int) string {
-	var title string
-	err := ebook.queries.getTitle.QueryRow(urlID).Scan(&title)
-	if err != nil {
-		log.Fatalf("Could not find url %v", err)
+	var terms []string
+	var matches []map[int][]Position
+	for _, part := range parts {
+		terms = append(terms, part.terms...)
+		matches = append(matches, part.matches)
 	}
-	return title
-}
 
-func (ebook *Index) getSentence(sentenceID int) string {
-	var sentence string
-	err := ebook.queries.getSentence.QueryRow(sentenceID).Scan(&sentence)
-	if err != nil {
-		log.Fatalf("Could not find sentence %v", err)
+	urlIDs := make([]int, 0, len(urls))
+	for urlID := range urls {
+		urlIDs = append(urlIDs, urlID)
 	}
-	return sentence
-}
-
-func (ebook *Index) getFreqSentence(urlID, wordID int) template.HTML {
-	var sentenceID int
-	var sentence string
-	err := ebook.queries.getFreqSentence.QueryRow(urlID, wordID).Scan(&sentenceID)
+	docStats, err := ebook.store.docStats(urlIDs)
 	if err != nil {
-		log.Fatalf("Could not find freq sentence %v", err)
+		return nil, 0, err
 	}
-	query := ebook.getWord(wordID)
-
-	sentence = ebook.getSentence(sentenceID)
-	// Bolding the query term in the sentence
-	sentence = strings.ReplaceAll(sentence, query, "<strong>"+query+"</strong>")
 
-	// If the sentence is too short (usually only one word)
-	// add the next sentence.
-	for len(sentence) < 100 {
-		sentenceID++
-		sentence += " " + ebook.getSentence(sentenceID)
+	top := newTopK(options.keep())
+	for _, urlID := range urlIDs {
+		stats := docStats[urlID]
+		score := 0.0
+		for _, part := range parts {
+			if occurrences := len(part.matches[urlID]); occurrences > 0 {
+				score += options.scorer.score(ebook.weighPart(part, urlID, occurrences), stats.totalTerms, len(part.matches), corpus)
+			}
+		}
+		score = blendAuthority(score, stats.authority, ebook.config.authorityWeight)
+		top.add(scoredURL{urlID: urlID, stats: stats, score: score})
 	}
-
-	return template.HTML(sentence)
+	return ebook.snippetResults(top, terms, matches)
 }
 
-func (ebook *Index) getBigramFreqSentence(urlID, word1ID, word2ID int) template.HTML {
-	var sentenceID int
-	var sentence string
-	err := ebook.queries.getBigramFreqSentence.QueryRow(urlID, word1ID, word2ID).Scan(&sentenceID)
-	if err != nil {
-		log.Fatalf("Could not find bigram freq sentence %v", err)
+// Returns the urls kept by top as results with snippets, best first, and the
+// amount of urls ranked. Snippets are only read for the urls kept.
+func (ebook *Index) snippetResults(top *topK, terms []string, matches []map[int][]Position) (TfIdfSlice, int, error) {
+	var tfIdfValues TfIdfSlice
+	for _, scored := range top.sorted() {
+		sentenceID := scored.sentenceID
+		if best := bestSentence(scored.urlID, matches); best != 0 {
+			sentenceID = best
+		}
+		snippet, err := ebook.getSnippet(scored.urlID, sentenceID)
+		if err != nil {
+			return nil, 0, err
+		}
+		tfIdfValues = append(tfIdfValues, newResult(scored.stats, scored.score, snippet, terms))
 	}
-	sentence = ebook.getSentence(sentenceID)
+	return tfIdfValues, top.total, nil
+}
 
-	for len(sentence) < 100 {
-		sentenceID++
-		sentence += " " + ebook.getSentence(sentenceID)
+// Returns how often the terms occur in the text of links to each url, by url
+// id. With all set the terms are a phrase, and a url counts as often as its
+// least linked term. Otherwise the terms are alternatives and their counts
+// are added up.
+func (ebook *Index) anchorCounts(terms []string, all bool) (map[int]int, error) {
+	var counts map[int]int
+	for _, term := range terms {
+		termID, err := ebook.store.findTerm(term)
+		if errors.Is(err, ErrNotFound) {
+			if all {
+				return nil, nil
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		termCounts, err := ebook.store.anchorCounts(termID)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case counts == nil:
+			counts = termCounts
+		case all:
+			for urlID, count := range counts {
+				counts[urlID] = min(count, termCounts[urlID])
+			}
+		default:
+			for urlID, count := range termCounts {
+				counts[urlID] += count
+			}
+		}
 	}
-
-	return template.HTML(sentence)
+	return counts, nil
 }
 
-// Print out the tf-idf value of a specific word on a specific url.
-func (ebook *Index) getTfIdf(word, url string) float64 {
-	urlID := ebook.findID("urls", url)
-	// fmt.Println("ID for ", url, "is ", urlID)
-	wordID := ebook.findID("words", word)
-	// fmt.Println("ID for ", word, "is ", wordID)
-
-	termOccurrencesinDoc := ebook.getOccurrences(urlID, wordID)
-	if termOccurrencesinDoc == 0 {
+// TF is the amount of times the term occurs in the document divided by the
+// total amount of words in the document. DF is the amount of docs the term
+// occurs in divided by the total amount of documents, and IDF is its inverse.
+func tfIdf(termOccurrencesinDoc float64, totalWordsinDoc, docsWithTerm, documentCount int) float64 {
+	if totalWordsinDoc == 0 || documentCount == 0 {
 		return 0
 	}
-	// fmt.Println("Amount of occurrences in doc:", termOccurrencesinDoc)
-
-	totalWordsinDoc := ebook.getTotalUrlWords(urlID)
-	// fmt.Println("Total words in ", url, ": ", totalWordsinDoc)
-
-	docsWithWord := ebook.getTotalDocsWithWord(wordID)
-	// fmt.Println("Total docs with word", word, ":", docsWithWord)
-
-	documentCount := ebook.getDocumentCount()
-	// fmt.Println("Total document count: ", documentCount)
-
-	// TF is the total amount of words in the document divided by
-	// the total amount of words in the document.
-	TF := float64(termOccurrencesinDoc) / float64(totalWordsinDoc)
-	// fmt.Println("TF:", TF)
-
-	// DF is the amount of times the docs the word occurs in
-	// divided by total amount of documents.
-	DF := float64(docsWithWord) / float64(documentCount)
-	// fmt.Println("DF:", DF)
+	TF := termOccurrencesinDoc / float64(totalWordsinDoc)
+	DF := float64(docsWithTerm) / float64(documentCount)
 	if DF == 0 {
 		return 0
 	}
@@ -251,86 +223,73 @@ func (ebook *Index) getTfIdf(word, url string) float64 {
 	return TF * IDF
 }
 
-// Sorts and returns a slice of tfIdf values.
-func (ebook *Index) sortTfIdf(word string) (tfIdfValues []TfIdfValue) {
+// Returns the best results for the word that the options ask for, and the
+// amount of urls it occurs in. A word that is not in the index has no
+// results.
+func (ebook *Index) sortTfIdf(word string, options SearchOptions) (TfIdfSlice, int, error) {
 	stemmedTerm, _ := snowball.Stem(word, "english", true)
-	wordID := ebook.findID("words", stemmedTerm)
-
-	validURLIDs := ebook.getAllURLsForWord(wordID)
+	termID, err := ebook.store.findTerm(stemmedTerm)
+	if errors.Is(err, ErrNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
 
-	for _, urlID := range validURLIDs {
-		url := ebook.getURL(urlID)
-		title := ebook.getTitle(urlID)
-		sentence := ebook.getFreqSentence(urlID, wordID)
-		tfIdf := ebook.getTfIdf(stemmedTerm, url)
-		tfIdfValues = append(tfIdfValues, TfIdfValue{Title: title, URL: url, TfIdf: tfIdf, Sentence: sentence})
+	postings, err := ebook.store.postings(termID)
+	if err != nil {
+		return nil, 0, err
 	}
-	sort.Slice(tfIdfValues, func(i, j int) bool {
-		if tfIdfValues[i].TfIdf == tfIdfValues[j].TfIdf {
-			return tfIdfValues[i].URL > tfIdfValues[j].URL
-		}
-		return tfIdfValues[i].TfIdf > tfIdfValues[j].TfIdf
-	})
-	return tfIdfValues
+	part := queryPart{terms: []string{stemmedTerm}}
+	if part.matches, err = ebook.store.positions(termID); err != nil {
+		return nil, 0, err
+	}
+	if part.anchors, err = ebook.store.anchorCounts(termID); err != nil {
+		return nil, 0, err
+	}
+	return ebook.rankPostings(postings, part, options)
 }
 
-// Print out the tf-idf value of a specific bigram on a specific url.
-func (ebook *Index) getBigramTfIdf(word1, word2, url string) float64 {
-	urlID := ebook.findID("urls", url)
-	// fmt.Println("ID for ", url, "is ", urlID)
-	word1ID, word2ID := ebook.findID("words", word1), ebook.findID("words", word2)
-	// fmt.Println("ID for ", word, "is ", wordID)
-
-	termOccurrencesinDoc := ebook.getBigramOccurrences(word1ID, word2ID, urlID)
-	if termOccurrencesinDoc == 0 {
-		return 0
+// Returns the best results for the bigram that the options ask for, and the
+// amount of urls it occurs in. A bigram with a word that is not in the index
+// has no results.
+func (ebook *Index) sortBigramTfIdf(word1, word2 string, options SearchOptions) (TfIdfSlice, int, error) {
+	term1ID, err := ebook.store.findTerm(word1)
+	if errors.Is(err, ErrNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	term2ID, err := ebook.store.findTerm(word2)
+	if errors.Is(err, ErrNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
 	}
-	// fmt.Println("Amount of occurrences in doc:", termOccurrencesinDoc)
-
-	totalWordsinDoc := ebook.getTotalUrlWords(urlID)
-	// fmt.Println("Total words in ", url, ": ", totalWordsinDoc)
-
-	docsWithWord := ebook.getTotalDocsWithBigram(word1ID, word2ID)
-	// fmt.Println("Total docs with bigram", word1, word2, ":", docsWithWord)
-
-	documentCount := ebook.getDocumentCount()
-	// fmt.Println("Total document count: ", documentCount)
-
-	// TF is the total amount of words in the document divided by
-	// the total amount of words in the document.
-	TF := float64(termOccurrencesinDoc) / float64(totalWordsinDoc)
-	// fmt.Println("TF:", TF)
 
-	// DF is the amount of times the docs the word occurs in
-	// divided by total amount of documents.
-	DF := float64(docsWithWord) / float64(documentCount)
-	// fmt.Println("DF:", DF)
-	if DF == 0 {
-		return 0
+	postings, err := ebook.store.bigramPostings(term1ID, term2ID)
+	if err != nil {
+		return nil, 0, err
 	}
-	IDF := float64(1 / DF)
-	return TF * IDF
+	// fmt.Println("Current bigram:", word1, word2, "urls:", len(postings))
+	part := queryPart{terms: []string{word1, word2}}
+	if part.matches, err = ebook.matchPhrase(phrase{terms: part.terms, offsets: []int{0, 1}}); err != nil {
+		return nil, 0, err
+	}
+	if part.anchors, err = ebook.anchorCounts(part.terms, true); err != nil {
+		return nil, 0, err
+	}
+	return ebook.rankPostings(postings, part, options)
 }
 
-// Sorts and returns a slice of tfIdf values.
-func (ebook *Index) sortBigramTfIdf(word1, word2 string) (tfIdfValues TfIdfSlice) {
-	word1ID, word2ID := ebook.findID("words", word1), ebook.findID("words", word2)
-
-	validURLIDs := ebook.getAllURLsForBigram(word1ID, word2ID)
-
-	for _, urlID := range validURLIDs {
-		url := ebook.getURL(urlID)
-		title := ebook.getTitle(urlID)
-		sentence := ebook.getBigramFreqSentence(urlID, word1ID, word2ID)
-		tfIdf := ebook.getBigramTfIdf(word1, word2, url)
-		// fmt.Println("Current url:", title, "Current bigram:", word1, word2, "Current TF-IDF:", tfIdf)
-		tfIdfValues = append(tfIdfValues, TfIdfValue{Title: title, URL: url, TfIdf: tfIdf, Sentence: sentence})
-	}
+// Sort the results by score, breaking ties by url.
+func sortResults(tfIdfValues TfIdfSlice) {
 	sort.Slice(tfIdfValues, func(i, j int) bool {
 		if tfIdfValues[i].TfIdf == tfIdfValues[j].TfIdf {
 			return tfIdfValues[i].URL > tfIdfValues[j].URL
 		}
 		return tfIdfValues[i].TfIdf > tfIdfValues[j].TfIdf
 	})
-	return tfIdfValues
 }
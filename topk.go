@@ -0,0 +1,74 @@
+package main
+
+import "container/heap"
+
+// A url that matched a query and has been scored, but has no snippet yet.
+type scoredURL struct {
+	urlID int
+	stats DocStats
+	score float64
+	// The first sentence of the posting, used for the snippet when no
+	// sentence has more matches.
+	sentenceID int
+}
+
+// Reports whether a ranks below b, in the order of sortResults.
+func ranksBelow(a, b scoredURL) bool {
+	if a.score == b.score {
+		return a.stats.url < b.stats.url
+	}
+	return a.score < b.score
+}
+
+// Keeps the k best of the urls added to it, so that only those need
+// snippets and the rest are never sorted. A k of 0 keeps every url.
+type topK struct {
+	k    int
+	heap scoredHeap
+	// The amount of urls added.
+	total int
+}
+
+func newTopK(k int) *topK {
+	return &topK{k: k}
+}
+
+func (top *topK) add(scored scoredURL) {
+	top.total++
+	if top.k <= 0 || top.heap.Len() < top.k {
+		heap.Push(&top.heap, scored)
+		return
+	}
+	// The worst url kept is at the root of the heap.
+	if ranksBelow(top.heap[0], scored) {
+		top.heap[0] = scored
+		heap.Fix(&top.heap, 0)
+	}
+}
+
+// Returns the urls kept, best first.
+func (top *topK) sorted() []scoredURL {
+	sorted := make([]scoredURL, top.heap.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(&top.heap).(scoredURL)
+	}
+	return sorted
+}
+
+// A min-heap of scored urls, with the one that ranks lowest first.
+type scoredHeap []scoredURL
+
+func (h scoredHeap) Len() int           { return len(h) }
+func (h scoredHeap) Less(i, j int) bool { return ranksBelow(h[i], h[j]) }
+func (h scoredHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *scoredHeap) Push(x any) {
+	*h = append(*h, x.(scoredURL))
+}
+
+func (h *scoredHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The words a wildcard pattern matched, as reported to the user.
+type Expansion struct {
+	Pattern string `json:"pattern"`
+	// The words as written that were searched, on the most urls first.
+	Words []string `json:"words"`
+	// Whether more words matched than were searched.
+	Truncated bool `json:"truncated"`
+	// The terms the words are stemmed to, without duplicates.
+	terms []string
+}
+
+// Reports whether the word is a wildcard pattern.
+func isPattern(word string) bool {
+	return strings.ContainsAny(word, "*?")
+}
+
+// Returns ErrParse for a pattern that would match every word.
+func checkPattern(pattern string) error {
+	if !strings.ContainsFunc(pattern, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) {
+		return queryError{"the wildcard " + pattern + " needs at least one letter, as in colo?r"}
+	}
+	return nil
+}
+
+// Returns the words as written on pages that match the pattern, where *
+// stands for any characters and ? for one. Only the words on the most urls
+// are kept when more match than the configured maximum.
+func (ebook *Index) expandPattern(pattern string) (Expansion, error) {
+	pattern = strings.ToLower(pattern)
+	limit := ebook.config.maxExpansions
+	forms, err := ebook.store.matchSurfaceForms(pattern, limit+1)
+	if err != nil {
+		return Expansion{}, err
+	}
+	expansion := Expansion{Pattern: pattern, Words: []string{}, Truncated: len(forms) > limit}
+	seen := make(map[string]struct{})
+	for _, form := range forms[:min(limit, len(forms))] {
+		expansion.Words = append(expansion.Words, form.form)
+		if _, exists := seen[form.term]; !exists {
+			seen[form.term] = struct{}{}
+			expansion.terms = append(expansion.terms, form.term)
+		}
+	}
+	return expansion, nil
+}
+
+// The most words of an expansion listed in its message.
+const listedExpansions = 10
+
+// Describes what the pattern was expanded to, for the user.
+func (expansion Expansion) message() string {
+	words := expansion.Words
+	switch {
+	case len(words) == 0:
+		return expansion.Pattern + " matched no words"
+	case expansion.Truncated:
+		return fmt.Sprintf("%s matched more than %d words, so only the %d on the most pages were searched", expansion.Pattern, len(words), len(words))
+	case len(words) > listedExpansions:
+		return fmt.Sprintf("%s matched %s and %d more", expansion.Pattern, strings.Join(words[:listedExpansions], ", "), len(words)-listedExpansions)
+	}
+	return expansion.Pattern + " matched " + strings.Join(words, ", ")
+}
+
+// Reports whether the text matches the pattern, where * stands for any
+// characters and ? for one.
+func matchWildcard(pattern, text string) bool {
+	p, t := []rune(pattern), []rune(text)
+	// Where the last * was in the pattern, and the text it matched up to.
+	star, matched := -1, 0
+	i, j := 0, 0
+	for j < len(t) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == t[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			star, matched = i, j
+			i++
+		case star >= 0:
+			// Let the last * match one more character and try again.
+			matched++
+			i, j = star+1, matched
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+// Returns the way each term is most often written, from the forms it is
+// written in. Forms on as many urls are decided alphabetically.
+func mostCommonForms(forms []SurfaceForm) map[string]string {
+	best := make(map[string]SurfaceForm)
+	for _, form := range forms {
+		current, exists := best[form.term]
+		if !exists || form.documents > current.documents || form.documents == current.documents && form.form < current.form {
+			best[form.term] = form
+		}
+	}
+	common := make(map[string]string, len(best))
+	for term, form := range best {
+		common[term] = form.form
+	}
+	return common
+}